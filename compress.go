@@ -0,0 +1,90 @@
+package jsonpb
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Compressor is a writer that compresses what is written to it, such as a
+// *gzip.Writer. Flush writes out pending data; Close finalizes the stream.
+type Compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Compression configures the compressor of a CompressedEncoder.
+type Compression struct {
+	// Encoding is the content coding of the output, as found in the
+	// Content-Encoding header. If empty, it defaults to "gzip".
+	Encoding string
+
+	// NewWriter returns a Compressor writing its output to w. If nil, it
+	// defaults to gzip.NewWriter.
+	NewWriter func(w io.Writer) Compressor
+
+	// OnEncoding, if set, is called with the Encoding before the first bytes
+	// are written, such as to set the Content-Encoding header of a response.
+	OnEncoding func(encoding string)
+}
+
+// CompressedEncoder is like the encoder returned by JSONPb.NewEncoder, except
+// that its output is compressed. Every value is flushed once it is encoded, so
+// that it reaches the reader of a stream without delay. Close must be called
+// to finalize the output.
+type CompressedEncoder struct {
+	j *JSONPb
+	w io.Writer
+	c Compression
+
+	cw Compressor
+}
+
+// NewCompressedEncoder returns a CompressedEncoder which writes a compressed
+// JSON stream into "w".
+func (j *JSONPb) NewCompressedEncoder(w io.Writer, c Compression) *CompressedEncoder {
+	if c.Encoding == "" {
+		c.Encoding = "gzip"
+	}
+	if c.NewWriter == nil {
+		c.NewWriter = func(w io.Writer) Compressor { return gzip.NewWriter(w) }
+	}
+	return &CompressedEncoder{j: j, w: w, c: c}
+}
+
+// Encode writes the JSON encoding of "v", followed by the delimiter, and
+// flushes it.
+func (e *CompressedEncoder) Encode(v interface{}) error {
+	cw := e.compressor()
+	if err := e.j.marshalTo(cw, v); err != nil {
+		return err
+	}
+	if _, err := cw.Write(e.j.Delimiter()); err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// Flush writes out any pending compressed data.
+func (e *CompressedEncoder) Flush() error {
+	if e.cw == nil {
+		return nil
+	}
+	return e.cw.Flush()
+}
+
+// Close finalizes the compressed stream. It does not close the underlying
+// writer. If nothing was encoded, it writes an empty compressed stream.
+func (e *CompressedEncoder) Close() error {
+	return e.compressor().Close()
+}
+
+// compressor returns the Compressor, setting it up on first use.
+func (e *CompressedEncoder) compressor() Compressor {
+	if e.cw == nil {
+		if e.c.OnEncoding != nil {
+			e.c.OnEncoding(e.c.Encoding)
+		}
+		e.cw = e.c.NewWriter(e.w)
+	}
+	return e.cw
+}
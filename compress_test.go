@@ -0,0 +1,48 @@
+package jsonpb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	var encoding string
+	enc := (&JSONPb{}).NewCompressedEncoder(&buf, Compression{OnEncoding: func(e string) { encoding = e }})
+	require.Empty(t, encoding)
+
+	require.NoError(t, enc.Encode(newMessage(t, nestedType, `{"name":"a"}`)))
+	require.Equal(t, "gzip", encoding)
+	flushed := buf.Len()
+	require.NotZero(t, flushed)
+	require.NoError(t, enc.Encode(map[string]int{"n": 1}))
+	require.NoError(t, enc.Close())
+
+	r, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "{\"name\":\"a\"}\n{\"n\":1}\n", string(actual))
+}
+
+func TestCompressedEncoderCustom(t *testing.T) {
+	var buf bytes.Buffer
+	enc := (&JSONPb{}).NewCompressedEncoder(&buf, Compression{
+		Encoding: "deflate",
+		NewWriter: func(w io.Writer) Compressor {
+			fw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return fw
+		},
+	})
+	require.NoError(t, enc.Encode(newMessage(t, nestedType, `{"count":"3"}`)))
+	require.NoError(t, enc.Close())
+
+	actual, err := io.ReadAll(flate.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, "{\"count\":3}\n", string(actual))
+}
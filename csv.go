@@ -0,0 +1,195 @@
+package jsonpb
+
+import (
+	"bytes"
+	"encoding/csv"
+	stdjson "encoding/json"
+	"io"
+	"reflect"
+
+	"jsonpb/encoding/json"
+	"jsonpb/errors"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// CSVContentType is the content type of the output of CSV.
+const CSVContentType = "text/csv"
+
+// CSV is a Marshaler which writes proto messages as the rows of a CSV table,
+// for tabular exports. Register it with
+// runtime.WithMarshalerOption(CSVContentType, &CSV{}).
+//
+// The table has a column for every top-level field of the message, headed by
+// the name of the field as written in JSON. A cell holds the JSON value of its
+// field under the MarshalOptions, with strings unquoted, so that well-known
+// types such as google.protobuf.Timestamp read as they do in JSON. Messages,
+// lists and maps are written as JSON text. Unpopulated fields are left empty.
+//
+// CSV only writes output; Unmarshal and the Decoder report an error.
+type CSV struct {
+	MarshalOptions
+
+	// Comma is the field delimiter. If zero, it defaults to ','.
+	Comma rune
+}
+
+// ContentType always returns CSVContentType.
+func (c *CSV) ContentType(_ interface{}) string {
+	return CSVContentType
+}
+
+// Marshal marshals "v", a proto message or a slice or array of proto messages
+// of the same type, into a CSV table with a row for every message, after the
+// header row.
+func (c *CSV) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	t, err := c.newTable(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.write(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal reports an error, as CSV input is not supported.
+func (c *CSV) Unmarshal(data []byte, v interface{}) error {
+	return errors.New("CSV input is not supported")
+}
+
+// NewDecoder returns a Decoder which reports an error, as CSV input is not
+// supported.
+func (c *CSV) NewDecoder(r io.Reader) runtime.Decoder {
+	return runtime.DecoderFunc(func(v interface{}) error {
+		return c.Unmarshal(nil, v)
+	})
+}
+
+// NewEncoder returns an Encoder which writes a CSV table into "w", such as for
+// a stream of messages. The header row is written along with the first value
+// encoded, and all the values must hold messages of the same type.
+func (c *CSV) NewEncoder(w io.Writer) runtime.Encoder {
+	t, err := c.newTable(w)
+	if err != nil {
+		return EncoderFunc(func(interface{}) error { return err })
+	}
+	return EncoderFunc(t.write)
+}
+
+// Delimiter returns nothing, as every row already ends with a line break.
+func (c *CSV) Delimiter() []byte {
+	return nil
+}
+
+// csvTable writes the rows of a CSV table.
+type csvTable struct {
+	opts MarshalOptions
+	w    *csv.Writer
+
+	// md is the type of the messages in the rows, once the header is written.
+	md protoreflect.MessageDescriptor
+}
+
+func (c *CSV) newTable(w io.Writer) (*csvTable, error) {
+	o, err := c.MarshalOptions.prepare()
+	if err != nil {
+		return nil, err
+	}
+	// Cells hold compact JSON.
+	o.Multiline, o.Indent = false, ""
+	cw := csv.NewWriter(w)
+	if c.Comma != 0 {
+		cw.Comma = c.Comma
+	}
+	return &csvTable{opts: o, w: cw}, nil
+}
+
+// write writes a row for the message v, or for every message in the slice or
+// array v, and flushes them.
+func (t *csvTable) write(v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		if err := t.writeRow(m); err != nil {
+			return err
+		}
+	} else {
+		rv := reflect.ValueOf(v)
+		if !rv.IsValid() || rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return errors.New("cannot marshal %T as CSV", v)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			m, ok := rv.Index(i).Interface().(proto.Message)
+			if !ok {
+				return errors.New("cannot marshal %T as a CSV row", rv.Index(i).Interface())
+			}
+			if err := t.writeRow(m); err != nil {
+				return err
+			}
+		}
+	}
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// writeRow writes the row for m, preceded by the header row if it is the
+// first one.
+func (t *csvTable) writeRow(m proto.Message) error {
+	pm := m.ProtoReflect()
+	md := pm.Descriptor()
+	fds := md.Fields()
+	e := encoder{opts: t.opts}
+
+	if t.md == nil {
+		header := make([]string, fds.Len())
+		for i := range header {
+			header[i] = e.fieldName(fds.Get(i))
+		}
+		if err := t.w.Write(header); err != nil {
+			return err
+		}
+		t.md = md
+	} else if md.FullName() != t.md.FullName() {
+		return errors.New("cannot mix %v with %v in CSV rows", md.FullName(), t.md.FullName())
+	}
+
+	row := make([]string, fds.Len())
+	for i := range row {
+		fd := fds.Get(i)
+		if !pm.Has(fd) {
+			continue
+		}
+		var err error
+		if row[i], err = t.cell(pm.Get(fd), fd); err != nil {
+			return err
+		}
+	}
+	return t.w.Write(row)
+}
+
+// cell returns the content of the cell for the value v of the field fd.
+func (t *csvTable) cell(v protoreflect.Value, fd protoreflect.FieldDescriptor) (string, error) {
+	internalEnc, err := json.NewEncoder(nil, "")
+	if err != nil {
+		return "", err
+	}
+	internalEnc.SetAllowLineSeparators(t.opts.AllowLineSeparators)
+	e := encoder{Encoder: internalEnc, opts: t.opts}
+	if e.opts.RedactFunc != nil {
+		e.path = e.fieldName(fd)
+	}
+	if err := e.marshalValue(v, fd); err != nil {
+		return "", err
+	}
+	b := e.Bytes()
+	if len(b) == 0 || b[0] != '"' {
+		return string(b), nil
+	}
+	var s string
+	if err := stdjson.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
@@ -0,0 +1,67 @@
+package jsonpb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testCSVProtoFile = `
+name: "jsonpb/csv.proto"
+package: "jsonpb.test.csv"
+syntax: "proto3"
+dependency: "jsonpb/test.proto"
+dependency: "google/protobuf/duration.proto"
+dependency: "google/protobuf/timestamp.proto"
+message_type {
+  name: "Export"
+  field { name: "id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "item_count" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+  field { name: "created_at" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Timestamp" }
+  field { name: "ttl" number: 4 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Duration" }
+  field { name: "nested" number: 5 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".jsonpb.test.Nested" }
+  field { name: "tags" number: 6 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "color" number: 7 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".jsonpb.test.Color" }
+}
+`
+
+func TestCSVMarshal(t *testing.T) {
+	fd := registerTestFile(testCSVProtoFile, new(protoregistry.Files), new(protoregistry.Types))
+	exportType := dynamicpb.NewMessageType(fd.Messages().ByName("Export"))
+	rows := []proto.Message{
+		newMessage(t, exportType, `{"id":"a, b","itemCount":"3","createdAt":"2023-08-29T10:30:00Z","ttl":"1.5s","nested":{"name":"n","count":"2"},"tags":["x","y"],"color":"GREEN"}`),
+		newMessage(t, exportType, `{"id":"c"}`),
+	}
+	marshaler := &CSV{}
+	require.Equal(t, "text/csv", marshaler.ContentType(rows))
+
+	actual, err := marshaler.Marshal(rows)
+	require.NoError(t, err)
+	want := "id,itemCount,createdAt,ttl,nested,tags,color\n" +
+		`"a, b",3,2023-08-29T10:30:00Z,1.500s,"{""name"":""n"",""count"":2}","[""x"",""y""]",GREEN` + "\n" +
+		"c,,,,,,\n"
+	require.Equal(t, want, string(actual))
+
+	records, err := csv.NewReader(bytes.NewReader(actual)).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a, b", "3", "2023-08-29T10:30:00Z", "1.500s", `{"name":"n","count":2}`, `["x","y"]`, "GREEN"}, records[1])
+
+	var buf bytes.Buffer
+	enc := (&CSV{MarshalOptions: MarshalOptions{UseProtoNames: true, UseEnumNumbers: true}, Comma: ';'}).NewEncoder(&buf)
+	for _, m := range rows {
+		require.NoError(t, enc.Encode(m))
+	}
+	require.Equal(t, "id;item_count;created_at;ttl;nested;tags;color\n"+
+		`a, b;3;2023-08-29T10:30:00Z;1.500s;"{""name"":""n"",""count"":2}";"[""x"",""y""]";2`+"\n"+
+		"c;;;;;;\n", string(buf.Bytes()))
+	require.Error(t, enc.Encode(newMessage(t, nestedType, `{}`)))
+
+	_, err = marshaler.Marshal(map[string]int{})
+	require.Error(t, err)
+	require.Error(t, marshaler.Unmarshal(actual, exportType.New().Interface()))
+}
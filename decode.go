@@ -0,0 +1,669 @@
+package jsonpb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"jsonpb/errors"
+	"jsonpb/genid"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// maxSparseLength bounds the length of a repeated field decoded from its
+// index-sparse form, so that a single large index cannot exhaust memory.
+const maxSparseLength = 1 << 20
+
+// Unmarshal reads the given []byte into the given proto.Message.
+// The provided message must be mutable (e.g., a non-nil pointer to a message).
+func Unmarshal(b []byte, m proto.Message) error {
+	return UnmarshalOptions{}.Unmarshal(b, m)
+}
+
+// UnmarshalOptions is a configurable JSON format parser. Parsing itself is
+// done by protojson; the options that go beyond protojson.UnmarshalOptions
+// rewrite the input into its canonical form beforehand.
+type UnmarshalOptions struct {
+	NoUnkeyedLiterals
+
+	// AllowPartial accepts input for messages that will result in missing
+	// required fields. If AllowPartial is false (the default), Unmarshal will
+	// return error if there are any missing required fields.
+	AllowPartial bool
+
+	// DiscardUnknown specifies whether to ignore unknown fields when parsing.
+	// An unknown field is any field whose field name or field number does not
+	// resolve to any known or extension field in the message.
+	// By default, unmarshal rejects unknown fields as an error.
+	DiscardUnknown bool
+
+	// Resolver is used for looking up types when unmarshaling
+	// google.protobuf.Any messages or extension fields.
+	// If nil, this defaults to using protoregistry.GlobalTypes.
+	Resolver interface {
+		protoregistry.MessageTypeResolver
+		protoregistry.ExtensionTypeResolver
+	}
+
+	// DecodingOptions holds the options that go beyond
+	// protojson.UnmarshalOptions.
+	DecodingOptions
+
+	// base holds the protojson options that JSONPb was configured with, so
+	// that all of them reach protojson. See DecodingOptions.withProtoJSON.
+	base protojson.UnmarshalOptions
+}
+
+// DecodingOptions are the decoding options of this package that go beyond
+// protojson.UnmarshalOptions. They rewrite the input into its canonical form
+// before it is parsed by protojson.
+type DecodingOptions struct {
+	NoUnkeyedLiterals
+
+	// SparseRepeated accepts the index-sparse form of repeated scalar fields
+	// written by MarshalOptions.SparseRepeated, e.g. {"3":"x"} for a repeated
+	// string field, in addition to the regular JSON array.
+	SparseRepeated bool
+
+	// EnumAliases, if set, provides alternative names accepted for enum
+	// values, such as names used before a value was renamed.
+	EnumAliases *EnumAliases
+
+	// FieldMaskAsArray accepts google.protobuf.FieldMask values given as a
+	// JSON array of lowerCamelCase paths, as written by
+	// MarshalOptions.FieldMaskAsArray, in addition to the comma-separated
+	// string.
+	FieldMaskAsArray bool
+
+	// StructBoolKeys hints at the google.protobuf.Struct entries that hold
+	// booleans, for legacy clients that send them as 0 and 1. Entries with one
+	// of these keys whose value is exactly 0 or 1 are read as false or true,
+	// at any depth within a Struct. Other numbers are kept as numbers.
+	StructBoolKeys []string
+
+	// BytesWithLength accepts bytes values given as an object holding the
+	// base64 encoding and the number of bytes, e.g. {"b64":"AQI=","len":2},
+	// as written by MarshalOptions.BytesWithLength, in addition to the base64
+	// string. A len that does not match the decoded bytes is an error; it may
+	// be left out.
+	BytesWithLength bool
+
+	// RootKey, if non-empty, expects the message to be nested under this key
+	// of a top-level object, e.g. {"payload":{...}}, as written by
+	// MarshalOptions.RootKey. Other top-level members are an error.
+	RootKey string
+
+	// ZonelessTimestamps accepts google.protobuf.Timestamp values that lack
+	// the "Z" or a UTC offset, e.g. "2023-08-29T00:00:00", and reads them as
+	// UTC. By default, such values are rejected as required by the
+	// specification.
+	ZonelessTimestamps bool
+
+	// LenientBools accepts the strings "yes", "on", "no" and "off", in any
+	// case, for bool fields and google.protobuf.BoolValue, as sent by clients
+	// converting HTML form values, in addition to the JSON booleans.
+	LenientBools bool
+
+	// RelaxedJSON accepts a developer-friendly subset of JSON5 in addition to
+	// standard JSON, such as for configuration endpoints: object keys may be
+	// left unquoted if they are identifiers, and strings may be quoted with
+	// single quotes, e.g. {name: 'a'}.
+	RelaxedJSON bool
+}
+
+// withProtoJSON returns the UnmarshalOptions that parse with the options po
+// after applying the options d.
+func (d DecodingOptions) withProtoJSON(po protojson.UnmarshalOptions) UnmarshalOptions {
+	return UnmarshalOptions{
+		AllowPartial:    po.AllowPartial,
+		DiscardUnknown:  po.DiscardUnknown,
+		Resolver:        po.Resolver,
+		DecodingOptions: d,
+		base:            po,
+	}
+}
+
+// Unmarshal reads the given []byte and populates the given proto.Message
+// using options in the UnmarshalOptions object.
+// It will clear the message first before setting the fields.
+// If it returns an error, the given message may be partially set.
+// The provided message must be mutable (e.g., a non-nil pointer to a message).
+func (o UnmarshalOptions) Unmarshal(b []byte, m proto.Message) error {
+	if o.Resolver == nil {
+		o.Resolver = protoregistry.GlobalTypes
+	}
+	if o.RelaxedJSON {
+		var err error
+		if b, err = relaxJSON(b); err != nil {
+			return err
+		}
+	}
+	if o.RootKey != "" {
+		var err error
+		if b, err = o.unwrapRoot(b); err != nil {
+			return err
+		}
+	}
+	if o.needsNormalize() {
+		var err error
+		if b, err = o.normalize(b, m.ProtoReflect().Descriptor()); err != nil {
+			return err
+		}
+	}
+	po := o.base
+	po.AllowPartial, po.DiscardUnknown, po.Resolver = o.AllowPartial, o.DiscardUnknown, o.Resolver
+	return po.Unmarshal(b, m)
+}
+
+// needsNormalize reports whether any option requires the input to be
+// rewritten before it is handed to protojson.
+func (o UnmarshalOptions) needsNormalize() bool {
+	return o.SparseRepeated || o.EnumAliases != nil || o.FieldMaskAsArray || len(o.StructBoolKeys) > 0 || o.BytesWithLength ||
+		o.ZonelessTimestamps || o.LenientBools
+}
+
+// unwrapRoot returns the value of the RootKey member of the JSON object b,
+// which must be its only member.
+func (o UnmarshalOptions) unwrapRoot(b []byte) ([]byte, error) {
+	if !json.Valid(b) {
+		return nil, errors.New("invalid JSON")
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	if tok, _ := d.Token(); tok != json.Delim('{') {
+		return nil, errors.New("expected an object with the single member %q", o.RootKey)
+	}
+	if name, _ := d.Token(); name != o.RootKey {
+		return nil, errors.New("expected an object with the single member %q", o.RootKey)
+	}
+	var v json.RawMessage
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	if tok, _ := d.Token(); tok != json.Delim('}') {
+		return nil, errors.New("expected an object with the single member %q", o.RootKey)
+	}
+	return v, nil
+}
+
+// normalize decodes the JSON document b, rewrites it against the message
+// descriptor md and encodes it again. Numbers are kept as their original
+// literals so that no precision is lost on the way, and objects keep the order
+// of their members, as well as any duplicates for protojson to reject.
+func (o UnmarshalOptions) normalize(b []byte, md protoreflect.MessageDescriptor) ([]byte, error) {
+	// Invalid UTF-8 would be replaced on the way rather than rejected.
+	if !utf8.Valid(b) {
+		return nil, errors.New("invalid UTF-8 in string")
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	v, err := decodeJSONValue(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after top-level value")
+	}
+	if v, err = o.normalizeMessage(v, md); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonMember is a member of a jsonObject.
+type jsonMember struct {
+	name  string
+	value interface{}
+}
+
+// jsonObject is a JSON object as decoded by decodeJSONValue. Unlike a map, it
+// keeps the members in their original order, duplicates included.
+type jsonObject []jsonMember
+
+// get returns the value of the first member called name.
+func (obj jsonObject) get(name string) (interface{}, bool) {
+	for _, m := range obj {
+		if m.name == name {
+			return m.value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON encodes the members of obj in order.
+func (obj jsonObject) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, m := range obj {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		name, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(append(b, name...), ':'), value...)
+	}
+	return append(b, '}'), nil
+}
+
+// decodeJSONValue reads the next JSON value from d. Objects are decoded as a
+// jsonObject and arrays as a []interface{}; other values are returned as the
+// tokens of d.
+func decodeJSONValue(d *json.Decoder) (interface{}, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for d.More() {
+			name, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(d)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonMember{name: name.(string), value: v})
+		}
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+
+	case json.Delim('['):
+		list := []interface{}{}
+		for d.More() {
+			v, err := decodeJSONValue(d)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+	return tok, nil
+}
+
+// normalizeMessage rewrites the JSON value v holding a message of type md.
+// Values of an unexpected JSON type are left alone for protojson to reject.
+func (o UnmarshalOptions) normalizeMessage(v interface{}, md protoreflect.MessageDescriptor) (interface{}, error) {
+	if md.FullName().Parent() == genid.GoogleProtobuf_package {
+		switch md.Name() {
+		case genid.Any_message_name:
+			return o.normalizeAny(v)
+		case genid.BoolValue_message_name,
+			genid.Int32Value_message_name,
+			genid.Int64Value_message_name,
+			genid.UInt32Value_message_name,
+			genid.UInt64Value_message_name,
+			genid.FloatValue_message_name,
+			genid.DoubleValue_message_name,
+			genid.StringValue_message_name,
+			genid.BytesValue_message_name:
+			return o.normalizeSingular(v, md.Fields().ByNumber(genid.WrapperValue_Value_field_number))
+		case genid.FieldMask_message_name:
+			if list, ok := v.([]interface{}); ok && o.FieldMaskAsArray {
+				return joinFieldMaskPaths(list)
+			}
+		case genid.Timestamp_message_name:
+			if str, ok := v.(string); ok && o.ZonelessTimestamps {
+				return zonelessTimestamp(str)
+			}
+		case genid.Struct_message_name, genid.ListValue_message_name, genid.Value_message_name:
+			if len(o.StructBoolKeys) > 0 {
+				return o.coerceStructBools(v), nil
+			}
+		}
+		if isWellKnown(md.FullName()) {
+			return v, nil
+		}
+	}
+
+	obj, ok := v.(jsonObject)
+	if !ok {
+		return v, nil
+	}
+	fds := md.Fields()
+	for i, m := range obj {
+		fd := fds.ByJSONName(m.name)
+		if fd == nil {
+			fd = fds.ByTextName(m.name)
+		}
+		if fd == nil {
+			continue // unknown fields are handled by protojson
+		}
+		var err error
+		if obj[i].value, err = o.normalizeField(m.value, fd); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// normalizeAny rewrites the embedded message of an Any, resolving its type
+// through the Resolver.
+func (o UnmarshalOptions) normalizeAny(v interface{}) (interface{}, error) {
+	obj, ok := v.(jsonObject)
+	if !ok {
+		return v, nil
+	}
+	t, _ := obj.get("@type")
+	typeURL, ok := t.(string)
+	if !ok {
+		return v, nil
+	}
+	emt, err := o.Resolver.FindMessageByURL(typeURL)
+	if err != nil {
+		return v, nil // protojson reports the unresolvable type
+	}
+	md := emt.Descriptor()
+	if isWellKnown(md.FullName()) {
+		for i, m := range obj {
+			if m.name != "value" {
+				continue
+			}
+			if obj[i].value, err = o.normalizeMessage(m.value, md); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	// The @type member matches no field and is therefore left alone.
+	return o.normalizeMessage(obj, md)
+}
+
+// normalizeField rewrites the JSON value v of the field fd.
+func (o UnmarshalOptions) normalizeField(v interface{}, fd protoreflect.FieldDescriptor) (interface{}, error) {
+	switch {
+	case fd.IsMap():
+		obj, ok := v.(jsonObject)
+		if !ok {
+			return v, nil
+		}
+		for i, m := range obj {
+			var err error
+			if obj[i].value, err = o.normalizeSingular(m.value, fd.MapValue()); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+
+	case fd.IsList():
+		if obj, ok := v.(jsonObject); ok && o.SparseRepeated && fd.Message() == nil {
+			var err error
+			if v, err = sparseToList(obj, fd); err != nil {
+				return nil, err
+			}
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return v, nil
+		}
+		for i, item := range list {
+			var err error
+			if list[i], err = o.normalizeSingular(item, fd); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+
+	default:
+		return o.normalizeSingular(v, fd)
+	}
+}
+
+// normalizeSingular rewrites a single, non-repeated value of the field fd.
+func (o UnmarshalOptions) normalizeSingular(v interface{}, fd protoreflect.FieldDescriptor) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if md := fd.Message(); md != nil {
+		return o.normalizeMessage(v, md)
+	}
+	if ed := fd.Enum(); ed != nil && o.EnumAliases != nil {
+		if s, ok := v.(string); ok && ed.Values().ByName(protoreflect.Name(s)) == nil {
+			if name, ok := o.EnumAliases.lookup(ed, s); ok {
+				return string(name), nil
+			}
+		}
+	}
+	if s, ok := v.(string); ok && fd.Kind() == protoreflect.BoolKind && o.LenientBools {
+		return lenientBool(s), nil
+	}
+	if obj, ok := v.(jsonObject); ok && fd.Kind() == protoreflect.BytesKind && o.BytesWithLength {
+		return bytesWithLength(obj, fd)
+	}
+	return v, nil
+}
+
+// lenientBool converts the strings accepted by LenientBools to booleans.
+// Other strings are left alone for protojson to reject.
+func lenientBool(s string) interface{} {
+	switch strings.ToLower(s) {
+	case "yes", "on":
+		return true
+	case "no", "off":
+		return false
+	}
+	return s
+}
+
+// zonelessTimestampLayout is RFC 3339 without the time zone offset.
+const zonelessTimestampLayout = "2006-01-02T15:04:05.999999999"
+
+// zonelessTimestamp appends the "Z" to a Timestamp value lacking a time zone
+// offset, so that it is read as UTC. Other values are left alone.
+func zonelessTimestamp(s string) (interface{}, error) {
+	t, err := time.ParseInLocation(zonelessTimestampLayout, s, time.UTC)
+	if err != nil {
+		return s, nil // either has an offset or is invalid for protojson to reject
+	}
+	if secs := t.Unix(); secs < minTimestampSeconds || secs > maxTimestampSeconds {
+		return nil, errors.New("%s: timestamp out of range %q", genid.Timestamp_message_fullname, s)
+	}
+	return s + "Z", nil
+}
+
+// bytesWithLength converts the object form of a bytes value written by
+// MarshalOptions.BytesWithLength to the base64 string, checking its length.
+func bytesWithLength(obj jsonObject, fd protoreflect.FieldDescriptor) (interface{}, error) {
+	for i, m := range obj {
+		if m.name != "b64" && m.name != "len" {
+			return nil, errors.New("%v: unexpected member %q of bytes value", fd.FullName(), m.name)
+		}
+		if _, dup := obj[:i].get(m.name); dup {
+			return nil, errors.New("%v: duplicate member %q of bytes value", fd.FullName(), m.name)
+		}
+	}
+	b64, _ := obj.get("b64")
+	s, ok := b64.(string)
+	if !ok {
+		return nil, errors.New("%v: missing b64 string", fd.FullName())
+	}
+	n, ok := obj.get("len")
+	if !ok {
+		return s, nil
+	}
+	b, err := decodeBase64(s)
+	if err != nil {
+		return nil, errors.New("%v: invalid base64 %q", fd.FullName(), s)
+	}
+	if num, ok := n.(json.Number); !ok || num.String() != strconv.Itoa(len(b)) {
+		return nil, errors.New("%v: len %v does not match the %d decoded bytes", fd.FullName(), n, len(b))
+	}
+	return s, nil
+}
+
+// decodeBase64 decodes s in any of the base64 encodings the JSON format
+// accepts: standard or URL-safe, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	enc := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.URLEncoding
+	}
+	if len(s)%4 != 0 {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	return enc.DecodeString(s)
+}
+
+// coerceStructBools rewrites the entries named by StructBoolKeys that hold 0
+// or 1 in the JSON value v of a Struct, a ListValue or a Value to booleans.
+func (o UnmarshalOptions) coerceStructBools(v interface{}) interface{} {
+	switch v := v.(type) {
+	case jsonObject:
+		for i, m := range v {
+			if n, ok := m.value.(json.Number); ok && o.isStructBoolKey(m.name) {
+				switch n {
+				case "0":
+					v[i].value = false
+					continue
+				case "1":
+					v[i].value = true
+					continue
+				}
+			}
+			v[i].value = o.coerceStructBools(m.value)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = o.coerceStructBools(item)
+		}
+	}
+	return v
+}
+
+func (o UnmarshalOptions) isStructBoolKey(k string) bool {
+	for _, key := range o.StructBoolKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// joinFieldMaskPaths converts the array form of a google.protobuf.FieldMask
+// to the canonical comma-separated string. Each path must be a lowerCamelCase
+// path that survives the conversion to snake_case and back.
+func joinFieldMaskPaths(list []interface{}) (string, error) {
+	paths := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return "", errors.New("%s: invalid path %v", genid.FieldMask_message_fullname, item)
+		}
+		sc := JSONSnakeCase(s)
+		if strings.Contains(s, ",") || !protoreflect.FullName(sc).IsValid() {
+			return "", errors.New("%s contains invalid path: %q", genid.FieldMask_Paths_field_fullname, s)
+		}
+		if s != JSONCamelCase(sc) {
+			return "", errors.New("%s contains irreversible value %q", genid.FieldMask_Paths_field_fullname, s)
+		}
+		paths = append(paths, s)
+	}
+	return strings.Join(paths, ","), nil
+}
+
+// sparseToList expands the index-sparse form of a repeated scalar field into a
+// JSON array, filling the gaps with the zero value of the field.
+func sparseToList(obj jsonObject, fd protoreflect.FieldDescriptor) ([]interface{}, error) {
+	n := 0
+	seen := make(map[int]bool, len(obj))
+	for _, m := range obj {
+		i, err := strconv.Atoi(m.name)
+		if err != nil || i < 0 || i >= maxSparseLength {
+			return nil, errors.New("%v: invalid sparse index %q", fd.FullName(), m.name)
+		}
+		if seen[i] {
+			return nil, errors.New("%v: duplicate sparse index %q", fd.FullName(), m.name)
+		}
+		seen[i] = true
+		if i >= n {
+			n = i + 1
+		}
+	}
+	list := make([]interface{}, n)
+	for i := range list {
+		list[i] = zeroJSONValue(fd.Kind())
+	}
+	for _, m := range obj {
+		i, _ := strconv.Atoi(m.name)
+		list[i] = m.value
+	}
+	return list, nil
+}
+
+// zeroJSONValue returns the JSON representation of the zero value of a scalar
+// field of the given kind.
+func zeroJSONValue(kind protoreflect.Kind) interface{} {
+	switch kind {
+	case protoreflect.BoolKind:
+		return false
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return ""
+	default:
+		return json.Number("0")
+	}
+}
+
+// EnumAliases holds alternative names for enum values that are accepted when
+// unmarshaling. The zero value is ready to use; it is safe for concurrent use.
+type EnumAliases struct {
+	mu      sync.RWMutex
+	aliases map[protoreflect.FullName]map[string]protoreflect.Name
+}
+
+// Register makes alias an alternative name for the value called name of the
+// enum ed. It returns an error if ed has no such value, or if alias is the
+// name of one of its values or already registered.
+func (a *EnumAliases) Register(ed protoreflect.EnumDescriptor, alias string, name protoreflect.Name) error {
+	if ed.Values().ByName(name) == nil {
+		return errors.New("%v has no value %v", ed.FullName(), name)
+	}
+	if ed.Values().ByName(protoreflect.Name(alias)) != nil {
+		return errors.New("%v already has a value %v", ed.FullName(), alias)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.aliases == nil {
+		a.aliases = map[protoreflect.FullName]map[string]protoreflect.Name{}
+	}
+	byAlias := a.aliases[ed.FullName()]
+	if byAlias == nil {
+		byAlias = map[string]protoreflect.Name{}
+		a.aliases[ed.FullName()] = byAlias
+	}
+	if prev, ok := byAlias[alias]; ok {
+		return errors.New("%v: alias %q already registered for %v", ed.FullName(), alias, prev)
+	}
+	byAlias[alias] = name
+	return nil
+}
+
+// lookup returns the name of the value of ed registered under alias.
+func (a *EnumAliases) lookup(ed protoreflect.EnumDescriptor, alias string) (protoreflect.Name, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	name, ok := a.aliases[ed.FullName()][alias]
+	return name, ok
+}
@@ -0,0 +1,324 @@
+package jsonpb
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestSparseRepeatedRoundTrip(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"tags": ["", "", "", "x", "", "", "", "y"],
+		"colors": ["RED", "GREEN"],
+		"values": [0, 0, 0, 1.5]
+	}`)
+
+	opts := MarshalOptions{SparseRepeated: true}
+	b, err := opts.Marshal(m)
+	require.NoError(t, err)
+	// colors is dense and therefore keeps the array form.
+	require.Equal(t, `{"tags":{"3":"x","7":"y"},"values":{"3":1.5},"colors":["RED","GREEN"]}`, string(b))
+
+	got := sampleType.New().Interface()
+	require.NoError(t, UnmarshalOptions{DecodingOptions: DecodingOptions{SparseRepeated: true}}.Unmarshal(b, got))
+	require.True(t, proto.Equal(m, got), "got %v, want %v", got, m)
+
+	// Without the option the sparse form is rejected.
+	require.Error(t, Unmarshal(b, sampleType.New().Interface()))
+}
+
+func TestSparseRepeatedTrailingZero(t *testing.T) {
+	// A trailing zero value cannot be recovered from the sparse form.
+	m := newMessage(t, sampleType, `{"tags": ["x", "", "", ""]}`)
+	b, err := MarshalOptions{SparseRepeated: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"tags":["x","","",""]}`, string(b))
+}
+
+func TestSparseRepeatedInvalidIndex(t *testing.T) {
+	for _, in := range []string{`{"tags":{"-1":"x"}}`, `{"tags":{"a":"x"}}`, `{"tags":{"1048576":"x"}}`, `{"tags":{"1":"x","01":"y"}}`} {
+		err := UnmarshalOptions{DecodingOptions: DecodingOptions{SparseRepeated: true}}.Unmarshal([]byte(in), sampleType.New().Interface())
+		require.Error(t, err, in)
+	}
+}
+
+func TestNormalizeDuplicateKeys(t *testing.T) {
+	// The input is rewritten for SparseRepeated, but duplicates are still
+	// rejected as by protojson.
+	opts := UnmarshalOptions{DecodingOptions: DecodingOptions{SparseRepeated: true}}
+	for _, in := range []string{
+		`{"id":"a","id":"b"}`,
+		`{"id":"a","nested":{"name":"x","name":"y"}}`,
+		`{"counts":{"k":1,"k":2}}`,
+		`{"attrs":{"k":1,"k":2}}`,
+		`{"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"x","name":"y"}}`,
+	} {
+		require.Error(t, Unmarshal([]byte(in), sampleType.New().Interface()), in)
+		require.Error(t, opts.Unmarshal([]byte(in), sampleType.New().Interface()), in)
+	}
+
+	m := sampleType.New().Interface()
+	require.NoError(t, opts.Unmarshal([]byte(`{"nested":{"name":"x"},"tags":{"1":"y"},"id":"a"}`), m))
+	want := newMessage(t, sampleType, `{"id":"a","tags":["","y"],"nested":{"name":"x"}}`)
+	require.True(t, proto.Equal(want, m), "got %v", m)
+}
+
+func TestNormalizeInvalidUTF8(t *testing.T) {
+	in := "{\"id\":\"\xff\"}"
+	require.Error(t, Unmarshal([]byte(in), sampleType.New().Interface()))
+	for _, opts := range []DecodingOptions{{SparseRepeated: true}, {LenientBools: true}, {ZonelessTimestamps: true}} {
+		err := UnmarshalOptions{DecodingOptions: opts}.Unmarshal([]byte(in), sampleType.New().Interface())
+		require.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestEnumAliases(t *testing.T) {
+	ed := sampleType.Descriptor().Fields().ByName("color").Enum()
+
+	var aliases EnumAliases
+	require.NoError(t, aliases.Register(ed, "CRIMSON", "RED"))
+	require.Error(t, aliases.Register(ed, "CRIMSON", "GREEN"))
+	require.Error(t, aliases.Register(ed, "GREEN", "RED"))
+	require.Error(t, aliases.Register(ed, "BLUE", "MISSING"))
+
+	opts := UnmarshalOptions{DecodingOptions: DecodingOptions{EnumAliases: &aliases}}
+	got := sampleType.New().Interface()
+	require.NoError(t, opts.Unmarshal([]byte(`{"color":"CRIMSON","colors":["GREEN","CRIMSON",2]}`), got))
+	want := newMessage(t, sampleType, `{"color":"RED","colors":["GREEN","RED","GREEN"]}`)
+	require.True(t, proto.Equal(want, got), "got %v, want %v", got, want)
+
+	// Unregistered names are still rejected.
+	require.Error(t, opts.Unmarshal([]byte(`{"color":"SCARLET"}`), sampleType.New().Interface()))
+	// Without the option the alias is unknown.
+	require.Error(t, Unmarshal([]byte(`{"color":"CRIMSON"}`), sampleType.New().Interface()))
+}
+
+func TestFieldMaskAsArray(t *testing.T) {
+	want := newMessage(t, sampleType, `{"mask":"id,managerId,nested.childName"}`)
+
+	b, err := MarshalOptions{FieldMaskAsArray: true}.Marshal(want)
+	require.NoError(t, err)
+	require.Equal(t, `{"mask":["id","managerId","nested.childName"]}`, string(b))
+
+	opts := UnmarshalOptions{DecodingOptions: DecodingOptions{FieldMaskAsArray: true}}
+	for _, in := range []string{
+		`{"mask":["id","managerId","nested.childName"]}`,
+		`{"mask":"id,managerId,nested.childName"}`,
+	} {
+		got := sampleType.New().Interface()
+		require.NoError(t, opts.Unmarshal([]byte(in), got), in)
+		require.True(t, proto.Equal(want, got), "got %v for %s", got, in)
+	}
+
+	got := sampleType.New().Interface()
+	require.NoError(t, opts.Unmarshal([]byte(`{"mask":[]}`), got))
+	require.True(t, proto.Equal(newMessage(t, sampleType, `{"mask":""}`), got))
+
+	for _, in := range []string{
+		`{"mask":["manager_id"]}`,
+		`{"mask":["id,flag"]}`,
+		`{"mask":["bad path"]}`,
+		`{"mask":[1]}`,
+	} {
+		require.Error(t, opts.Unmarshal([]byte(in), sampleType.New().Interface()), in)
+	}
+	require.Error(t, Unmarshal([]byte(`{"mask":["id"]}`), sampleType.New().Interface()))
+}
+
+func TestStructBoolKeys(t *testing.T) {
+	src := `{"attrs": {"active": 1, "deleted": 0, "count": 1, "ratio": 1.0, "nested": {"active": 0, "items": [{"active": 1}]}}}`
+
+	m := sampleType.New().Interface()
+	require.NoError(t, Unmarshal([]byte(src), m))
+	want := newMessage(t, sampleType, src)
+	require.True(t, proto.Equal(want, m), "numbers are kept by default, got %v", m)
+
+	m = sampleType.New().Interface()
+	require.NoError(t, UnmarshalOptions{DecodingOptions: DecodingOptions{StructBoolKeys: []string{"active", "deleted", "ratio"}}}.Unmarshal([]byte(src), m))
+	want = newMessage(t, sampleType, `{"attrs": {"active": true, "deleted": false, "count": 1, "ratio": 1.0, "nested": {"active": false, "items": [{"active": true}]}}}`)
+	require.True(t, proto.Equal(want, m), "got %v", m)
+}
+
+func TestStructNumberEdgeCases(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+		out  string
+	}{
+		{`1e308`, 1e308, `1e+308`},
+		{`-1.7976931348623157e308`, -math.MaxFloat64, `-1.7976931348623157e+308`},
+		{`-0`, math.Copysign(0, -1), `-0`},
+		{`-0.0`, math.Copysign(0, -1), `-0`},
+		{`5e-324`, math.SmallestNonzeroFloat64, `5e-324`},
+		{`2.2250738585072014e-308`, 2.2250738585072014e-308, `2.2250738585072014e-308`},
+		{`1E+2`, 100, `100`},
+		{`0.1`, 0.1, `0.1`},
+	}
+	// The normalizer, enabled by StructBoolKeys, keeps number literals as is.
+	for _, opts := range []UnmarshalOptions{{}, {DecodingOptions: DecodingOptions{StructBoolKeys: []string{"flag"}}}} {
+		for _, tt := range tests {
+			st := new(structpb.Struct)
+			require.NoError(t, opts.Unmarshal([]byte(`{"n":`+tt.src+`}`), st), tt.src)
+			require.Equal(t, math.Float64bits(tt.want), math.Float64bits(st.Fields["n"].GetNumberValue()), tt.src)
+
+			actual, err := Marshal(st)
+			require.NoError(t, err, tt.src)
+			require.Equal(t, `{"n":`+tt.out+`}`, string(actual), tt.src)
+
+			again := new(structpb.Struct)
+			require.NoError(t, opts.Unmarshal(actual, again), tt.src)
+			require.True(t, proto.Equal(st, again), tt.src)
+		}
+	}
+
+	require.Error(t, Unmarshal([]byte(`{"n":1e309}`), new(structpb.Struct)))
+}
+
+func TestBytesWithLength(t *testing.T) {
+	m := newMessage(t, sampleType, `{"data":"AQID/w==","alias":"x"}`)
+	data := m.ProtoReflect().Get(sampleType.Descriptor().Fields().ByName("data")).Bytes()
+
+	actual, err := MarshalOptions{BytesWithLength: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"data":{"b64":"AQID/w==","len":4},"alias":"x"}`, string(actual))
+	require.Len(t, data, 4)
+
+	got := sampleType.New().Interface()
+	require.NoError(t, UnmarshalOptions{DecodingOptions: DecodingOptions{BytesWithLength: true}}.Unmarshal(actual, got))
+	require.True(t, proto.Equal(m, got), "got %v", got)
+
+	for _, src := range []string{`{"data":"AQID/w=="}`, `{"data":{"b64":"AQID_w"}}`, `{"data":{"b64":"AQID/w","len":4}}`} {
+		got := sampleType.New().Interface()
+		require.NoError(t, UnmarshalOptions{DecodingOptions: DecodingOptions{BytesWithLength: true}}.Unmarshal([]byte(src), got), src)
+		require.Equal(t, data, got.ProtoReflect().Get(sampleType.Descriptor().Fields().ByName("data")).Bytes(), src)
+	}
+
+	for _, src := range []string{`{"data":{"b64":"AQID/w==","len":3}}`, `{"data":{"len":4}}`, `{"data":{"b64":"AQID/w==","size":4}}`} {
+		require.Error(t, UnmarshalOptions{DecodingOptions: DecodingOptions{BytesWithLength: true}}.Unmarshal([]byte(src), sampleType.New().Interface()), src)
+	}
+	require.Error(t, Unmarshal(actual, sampleType.New().Interface()))
+}
+
+func TestZonelessTimestamps(t *testing.T) {
+	src := `{"createdAt":"2023-08-29T00:00:00"}`
+	require.Error(t, Unmarshal([]byte(src), sampleType.New().Interface()))
+
+	opts := UnmarshalOptions{DecodingOptions: DecodingOptions{ZonelessTimestamps: true}}
+	for _, tt := range []struct{ src, want string }{
+		{src, `{"createdAt":"2023-08-29T00:00:00Z"}`},
+		{`{"createdAt":"2023-08-29T12:30:00.5"}`, `{"createdAt":"2023-08-29T12:30:00.500Z"}`},
+		{`{"createdAt":"2023-08-29T12:30:00+02:00"}`, `{"createdAt":"2023-08-29T10:30:00Z"}`},
+		{`{"createdAt":"2023-08-29T12:30:00Z"}`, `{"createdAt":"2023-08-29T12:30:00Z"}`},
+	} {
+		m := sampleType.New().Interface()
+		require.NoError(t, opts.Unmarshal([]byte(tt.src), m), tt.src)
+		actual, err := Marshal(m)
+		require.NoError(t, err, tt.src)
+		require.Equal(t, tt.want, string(actual), tt.src)
+	}
+
+	ts := new(timestamppb.Timestamp)
+	require.NoError(t, opts.Unmarshal([]byte(`"9999-12-31T23:59:59.999999999"`), ts))
+	require.Equal(t, int64(253402300799), ts.GetSeconds())
+
+	for _, src := range []string{`"0000-01-01T00:00:00"`, `"2023-08-29"`, `"2023-08-29T24:00:00"`} {
+		require.Error(t, opts.Unmarshal([]byte(src), new(timestamppb.Timestamp)), src)
+	}
+}
+
+func TestLenientBools(t *testing.T) {
+	require.Error(t, Unmarshal([]byte(`{"flag":"yes"}`), sampleType.New().Interface()))
+
+	opts := UnmarshalOptions{DecodingOptions: DecodingOptions{LenientBools: true}}
+	for _, tt := range []struct {
+		src  string
+		want bool
+	}{
+		{`"yes"`, true}, {`"YES"`, true}, {`"on"`, true}, {`"On"`, true}, {`true`, true},
+		{`"no"`, false}, {`"No"`, false}, {`"off"`, false}, {`"OFF"`, false}, {`false`, false},
+	} {
+		m := sampleType.New().Interface()
+		require.NoError(t, opts.Unmarshal([]byte(`{"flag":`+tt.src+`,"enabled":`+tt.src+`}`), m), tt.src)
+		want := newMessage(t, sampleType, `{"flag":`+strconv.FormatBool(tt.want)+`,"enabled":`+strconv.FormatBool(tt.want)+`}`)
+		require.True(t, proto.Equal(want, m), "%s: got %v", tt.src, m)
+
+		bv := new(wrapperspb.BoolValue)
+		require.NoError(t, opts.Unmarshal([]byte(tt.src), bv), tt.src)
+		require.Equal(t, tt.want, bv.GetValue(), tt.src)
+	}
+
+	for _, src := range []string{`{"flag":"y"}`, `{"flag":"true"}`, `{"flag":1}`, `{"enabled":"maybe"}`, `{"id":"yes","flag":"nope"}`} {
+		require.Error(t, opts.Unmarshal([]byte(src), sampleType.New().Interface()), src)
+	}
+	m := sampleType.New().Interface()
+	require.NoError(t, opts.Unmarshal([]byte(`{"id":"yes"}`), m))
+	require.True(t, proto.Equal(newMessage(t, sampleType, `{"id":"yes"}`), m))
+}
+
+func TestRelaxedJSON(t *testing.T) {
+	src := `{
+		id: 'it\'s "quoted"',
+		managerId: 7,
+		$schema: 'config.json',
+		"tags": ['a', "b", 'c\\d'],
+		nested: {name: 'n:1', count: '2', child: {name: "x: y"}},
+		color: 'GREEN',
+		ratio: -1.5e3
+	}`
+	require.Error(t, Unmarshal([]byte(src), sampleType.New().Interface()))
+
+	want := newMessage(t, sampleType, `{"id":"it's \"quoted\"","managerId":"7","tags":["a","b","c\\d"],"nested":{"name":"n:1","count":"2","child":{"name":"x: y"}},"color":"GREEN","ratio":-1500}`)
+	opts := UnmarshalOptions{DiscardUnknown: true, DecodingOptions: DecodingOptions{RelaxedJSON: true}}
+	m := sampleType.New().Interface()
+	require.NoError(t, opts.Unmarshal([]byte(src), m))
+	require.True(t, proto.Equal(want, m), "got %v", m)
+
+	m = sampleType.New().Interface()
+	marshaler := &JSONPb{UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true}, Decoding: DecodingOptions{RelaxedJSON: true}}
+	require.NoError(t, marshaler.Unmarshal([]byte(src), m))
+	require.True(t, proto.Equal(want, m), "got %v", m)
+
+	var v struct {
+		Name string `json:"name"`
+		At   *timestamppb.Timestamp
+	}
+	require.NoError(t, marshaler.Unmarshal([]byte(`{name: 'n', At: '1970-01-01T00:00:01Z'}`), &v))
+	require.Equal(t, "n", v.Name)
+	require.Equal(t, int64(1), v.At.GetSeconds())
+
+	for _, src := range []string{`{id: 'open}`, `{id: x}`, `{'id' 'x'}`} {
+		require.Error(t, opts.Unmarshal([]byte(src), sampleType.New().Interface()), src)
+	}
+
+	// The stream decoders rewrite their input as well.
+	dec := marshaler.NewDecoder(strings.NewReader(src + "\n{id: 'b'} {name: 'plain'}"))
+	m = sampleType.New().Interface()
+	require.NoError(t, dec.Decode(m))
+	require.True(t, proto.Equal(want, m), "got %v", m)
+	m = sampleType.New().Interface()
+	require.NoError(t, dec.Decode(m))
+	require.True(t, proto.Equal(newMessage(t, sampleType, `{"id":"b"}`), m), "got %v", m)
+	var plain struct{ Name string }
+	require.NoError(t, dec.Decode(&plain))
+	require.Equal(t, "plain", plain.Name)
+	require.Equal(t, io.EOF, dec.Decode(sampleType.New().Interface()))
+
+	dec = marshaler.NewSequenceDecoder(strings.NewReader("\x1e{id: 'a'}\n\x1e{id: 'b', tags: ['x']}\n"))
+	for _, want := range []string{`{"id":"a"}`, `{"id":"b","tags":["x"]}`} {
+		m = sampleType.New().Interface()
+		require.NoError(t, dec.Decode(m))
+		require.True(t, proto.Equal(newMessage(t, sampleType, want), m), "got %v", m)
+	}
+	require.Equal(t, io.EOF, dec.Decode(sampleType.New().Interface()))
+
+	require.Error(t, marshaler.NewDecoder(strings.NewReader(`{id: 'open}`)).Decode(sampleType.New().Interface()))
+}
@@ -5,8 +5,14 @@
 package jsonpb
 
 import (
+	"bytes"
 	"encoding/base64"
+	stdjson "encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"jsonpb/encoding/json"
 	"jsonpb/errors"
@@ -49,6 +55,33 @@ func Format(m proto.Message) string {
 	return MarshalOptions{Multiline: true}.Format(m)
 }
 
+// Pretty formats the message for reading by people, such as in the output of
+// debugging tools: indented, with the members of every object sorted by name,
+// enum values written by name and timestamps in RFC 3339 form.
+// The output is not guaranteed to follow the JSON mapping of the protobuf
+// specification, nor to be stable, so do not parse it back.
+func Pretty(m proto.Message) (string, error) {
+	b, err := MarshalOptions{Multiline: true, AllowPartial: true}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	// Numbers are kept as their literals, so that no precision is lost.
+	d := stdjson.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	enc := stdjson.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", defaultIndent)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
 // Marshal writes the given proto.Message in JSON format using default options.
 // Do not depend on the output being stable. It may change over time across
 // different versions of the program.
@@ -83,6 +116,41 @@ type MarshalOptions struct {
 	// UseEnumNumbers emits enum values as numbers.
 	UseEnumNumbers bool
 
+	// EnumNameExtension, if set, is a string extension of
+	// google.protobuf.EnumValueOptions holding an alternative JSON name for
+	// enum values, e.g. (json_alias) = "gold". Values with a non-empty alias
+	// are written as the alias, others by their name. Aliases are not read
+	// back unless they are registered with UnmarshalOptions.EnumAliases.
+	EnumNameExtension protoreflect.ExtensionType
+
+	// EmptyZeroEnums emits the zero value of an enum as "" rather than its
+	// name, for clients that treat it as "no value". Such values are mostly
+	// seen with EmitUnpopulated. It has no effect with UseEnumNumbers.
+	EmptyZeroEnums bool
+
+	// Int64AsString emits 64-bit integer fields (int64, sint64, sfixed64,
+	// uint64 and fixed64) as quoted decimal strings, as the proto3 JSON
+	// mapping mandates, instead of the JSON numbers this package writes by
+	// default. For values that are not protos, it quotes Go fields of kind
+	// int64 and uint64. Map keys are strings either way.
+	Int64AsString bool
+
+	// EmitFloatDecimal emits integral float and double values with a ".0"
+	// fraction, e.g. 5.0 instead of 5, so that they are distinguishable from
+	// integers. Values written in exponent form are left as is.
+	EmitFloatDecimal bool
+
+	// BytesWithLength writes bytes values as an object holding the base64
+	// encoding along with the number of bytes, e.g. {"b64":"AQI=","len":2},
+	// for clients that validate payloads. UnmarshalOptions.BytesWithLength
+	// accepts this form.
+	BytesWithLength bool
+
+	// RejectNonFinite makes NaN and infinite float and double values an error
+	// instead of writing them as the strings "NaN", "Infinity" and
+	// "-Infinity", for clients that only accept JSON numbers.
+	RejectNonFinite bool
+
 	// EmitUnpopulated specifies whether to emit unpopulated fields. It does not
 	// emit unpopulated oneof fields or unpopulated extension fields.
 	// The JSON value emitted for unpopulated fields are as follows:
@@ -99,6 +167,168 @@ type MarshalOptions struct {
 	//  ╚═══════╧════════════════════════════╝
 	EmitUnpopulated bool
 
+	// SparseRepeated emits repeated scalar fields whose elements are mostly
+	// zero values as a JSON object keyed by the index of each non-zero
+	// element, e.g. {"3":"x","7":"y"}. It only does so when fewer than half of
+	// the elements are non-zero and the last one is, so that the length can be
+	// recovered. UnmarshalOptions.SparseRepeated accepts this form.
+	SparseRepeated bool
+
+	// CamelCaseMapKeys converts the keys of string-keyed maps to lowerCamelCase
+	// with JSONCamelCase. It applies to proto map fields and to Go maps with
+	// proto.Message values, but not to google.protobuf.Struct, whose keys are
+	// data rather than names.
+	CamelCaseMapKeys bool
+
+	// DualMapKeys writes every entry of the maps affected by CamelCaseMapKeys
+	// twice, under its original key and under the lowerCamelCase one, such as
+	// while clients move from one convention to the other. Note that this
+	// doubles the size of these maps in the output. Entries whose key is
+	// already in lowerCamelCase, or whose lowerCamelCase key is also in the
+	// map, are written once, and so are entries whose lowerCamelCase key is
+	// shared with an entry written before, such as "a__b" and "a_b" for "aB".
+	// It takes precedence over CamelCaseMapKeys.
+	DualMapKeys bool
+
+	// TimestampFractionDigits, if set, forces google.protobuf.Timestamp values
+	// to be written with exactly 0, 3, 6 or 9 fractional second digits,
+	// truncating any further precision, e.g. FractionDigits(0) for whole
+	// seconds. If nil, trailing zeros are trimmed so that 0, 3, 6 or 9 digits
+	// are written as needed. Any other value is rejected.
+	TimestampFractionDigits *int
+
+	// DurationFractionDigits is like TimestampFractionDigits, for
+	// google.protobuf.Duration values and the timestamps written with
+	// TimestampsRelativeTo. The two are independent, e.g. durations can be
+	// written with a fixed precision while timestamps are trimmed.
+	DurationFractionDigits *int
+
+	// TimestampsRelativeTo, if non-zero, writes google.protobuf.Timestamp
+	// values as the google.protobuf.Duration since this reference time, e.g.
+	// "-5s" for five seconds before it, for internal dashboards. The output is
+	// not valid for the Timestamp type, and cannot be read back.
+	TimestampsRelativeTo time.Time
+
+	// FieldMaskAsArray writes google.protobuf.FieldMask values as a JSON array
+	// of lowerCamelCase paths instead of a single comma-separated string.
+	// UnmarshalOptions.FieldMaskAsArray accepts this form.
+	FieldMaskAsArray bool
+
+	// UntypedAnyKey, if non-empty, makes a google.protobuf.Any that has a
+	// value but no type URL marshal as an object holding the base64-encoded
+	// value under this key, e.g. {"raw":"CgFh"}, for lenient proxies. By
+	// default such an Any is an error.
+	UntypedAnyKey string
+
+	// AllowLineSeparators writes the line and paragraph separators U+2028 and
+	// U+2029 in strings as is. By default they are escaped as \u2028 and
+	// \u2029, like encoding/json does, since they break JavaScript code that
+	// evaluates the output, such as JSONP.
+	AllowLineSeparators bool
+
+	// EmptyTemplate, if non-empty, is the JSON written instead of {} for a
+	// top-level message that marshals without any fields, such as
+	// {"data":{},"meta":{}}, so that clients always see the same shape. It
+	// must be valid JSON, and is re-indented to match Indent.
+	EmptyTemplate string
+
+	// EmitPresenceMask adds a "_fieldMask" member to the top-level message
+	// that mirrors its structure with a boolean for each field telling whether
+	// it is populated, e.g. {"id":"a","_fieldMask":{"id":true,"nested":{...}}}.
+	// Populated message fields map to the mask of their value, except for
+	// well-known types. It is meant for PATCH responses. In the envelope
+	// written with Paginate, the repeated field is named after the items.
+	EmitPresenceMask bool
+
+	// RootKey, if non-empty, nests the output for a message under this key,
+	// e.g. {"payload":{...}}, for clients that expect a fixed wrapper.
+	// UnmarshalOptions.RootKey reads it back.
+	RootKey string
+
+	// Paginate wraps list responses in an envelope of the form
+	// {"items":[...],"count":N}. A list response is a top-level message with
+	// exactly one repeated field and otherwise only the pagination fields
+	// next_page_token, previous_page_token and total_size, or one of
+	// PageTypes. Its repeated field is moved to the items key while the other
+	// fields are written next to it, and may not be named like the members of
+	// the envelope. For values that are not protos, a list response is a Go
+	// slice or array. Other values are written as usual.
+	Paginate bool
+
+	// PageTypes lists the message types written as list responses with
+	// Paginate besides those detected as such, for messages with fields other
+	// than pagination fields. They must have exactly one repeated field.
+	PageTypes []protoreflect.FullName
+
+	// PageItemsKey and PageCountKey name the members of the envelope written
+	// with Paginate. They default to "items" and "count".
+	PageItemsKey string
+	PageCountKey string
+
+	// NumberFormatter, if set, formats the values of integer, float and double
+	// fields in place of the built-in formatting and of the options affecting
+	// it, such as Int64AsString. Its output must be valid JSON.
+	NumberFormatter NumberFormatter
+
+	// RedactFunc, if set, is called with every scalar value written, including
+	// enums and the values within well-known types such as wrappers and
+	// google.protobuf.Struct, such as to hide values that look like secrets.
+	// If it reports true, the returned replacement is written as a JSON string
+	// in place of the value. The path locates the value from the top-level
+	// message, joining the names of fields with "." and appending list indexes
+	// and map keys in brackets, e.g. "children[0].name" or "attrs[key]".
+	RedactFunc func(path string, value protoreflect.Value) (bool, string)
+
+	// MaxFields, if positive, limits the number of members of every JSON
+	// object written for a message or a map, including google.protobuf.Struct,
+	// so that pathologically wide values are rejected with an error instead of
+	// producing huge outputs. All members count, such as "@type", the presence
+	// mask and the members of the page envelope.
+	MaxFields int
+
+	// InvalidValuesAsNull writes null for the google.protobuf.Value messages
+	// that have no JSON representation, namely those with no kind set and
+	// those holding a NaN or infinite number, instead of failing with a
+	// *FieldPathError locating the first of them.
+	InvalidValuesAsNull bool
+
+	// DiscriminatorKey, if non-empty, adds OpenAPI-style discriminator
+	// members, so that the clients generated from an OpenAPI document can
+	// tell the alternatives of a polymorphic value apart:
+	//   - An Any gets a member named DiscriminatorKey holding the full name of
+	//     the message it embeds, e.g. {"@type":"...","type":"pkg.Circle",...}.
+	//   - Every populated oneof gets a member named after the oneof and
+	//     DiscriminatorKey, holding the name of the field that is set, e.g.
+	//     {"circle":{...},"shapeType":"circle"} for the oneof shape and the
+	//     key "type" (or "shape_type" under UseProtoNames).
+	//
+	// These members are not part of the JSON mapping, and reading the output
+	// back requires UnmarshalOptions.DiscardUnknown. They count towards
+	// MaxFields, and it is an error for their names to collide with those of
+	// the other members of the object.
+	DiscriminatorKey string
+
+	// TopLevelSnakeCase writes the names of the members of the top-level JSON
+	// object in snake_case, e.g. "manager_id", for APIs that mix conventions.
+	// It applies to the fields of the top-level message and of a top-level Go
+	// struct, but not to map keys, nor to nested messages and structs.
+	TopLevelSnakeCase bool
+
+	// Stable makes the output a deterministic function of the message value
+	// and the options, such as for caching responses by a hash of their
+	// content. The entries of maps, including google.protobuf.Struct and the
+	// maps of Go values, are always sorted by key. Stable additionally sorts
+	// the members written for message fields by name, so that the output does
+	// not depend on the order in which fields are declared. The "@type" of an
+	// Any stays first, and the "_fieldMask" of EmitPresenceMask stays last.
+	Stable bool
+
+	// NilSliceAsEmptyArray writes nil slices within Go values that are not
+	// proto messages as [] rather than null, matching how repeated fields are
+	// written. It does not apply to []byte, nor to struct fields left out by
+	// the omitempty tag option.
+	NilSliceAsEmptyArray bool
+
 	// Resolver is used for looking up types when expanding google.protobuf.Any
 	// messages. If nil, this defaults to using protoregistry.GlobalTypes.
 	Resolver interface {
@@ -107,6 +337,12 @@ type MarshalOptions struct {
 	}
 }
 
+// FractionDigits returns a pointer to n, for setting
+// MarshalOptions.TimestampFractionDigits and DurationFractionDigits.
+func FractionDigits(n int) *int {
+	return &n
+}
+
 // Format formats the message as a string.
 // This method is only intended for human consumption and ignores errors.
 // Do not depend on the output being stable. It may change over time across
@@ -124,26 +360,85 @@ func (o MarshalOptions) Format(m proto.Message) string {
 // MarshalOptions. Do not depend on the output being stable. It may change over
 // time across different versions of the program.
 func (o MarshalOptions) Marshal(m proto.Message) ([]byte, error) {
-	return o.marshal(nil, m)
+	return o.MarshalAppend(nil, m)
 }
 
 // MarshalAppend appends the JSON format encoding of m to b,
 // returning the result.
 func (o MarshalOptions) MarshalAppend(b []byte, m proto.Message) ([]byte, error) {
-	return o.marshal(b, m)
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+	return o.marshal(b, m, nil, nil)
 }
 
-// marshal is a centralized function that all marshal operations go through.
-// For profiling purposes, avoid changing the name of this function or
-// introducing other code paths for marshal that do not go through this.
-func (o MarshalOptions) marshal(b []byte, m proto.Message) ([]byte, error) {
+// validate reports whether the options form a usable configuration.
+func (o MarshalOptions) validate() error {
+	if strings.Trim(o.Indent, " \t") != "" {
+		return errors.New("indent may only be composed of space or tab characters")
+	}
+	if n := o.TimestampFractionDigits; n != nil {
+		switch *n {
+		case 0, 3, 6, 9:
+		default:
+			return errors.New("invalid timestamp fraction digits %d: must be 0, 3, 6 or 9", *n)
+		}
+	}
+	if n := o.DurationFractionDigits; n != nil {
+		switch *n {
+		case 0, 3, 6, 9:
+		default:
+			return errors.New("invalid duration fraction digits %d: must be 0, 3, 6 or 9", *n)
+		}
+	}
+	if o.EmptyTemplate != "" && !stdjson.Valid([]byte(o.EmptyTemplate)) {
+		return errors.New("empty template is not valid JSON: %q", o.EmptyTemplate)
+	}
+	if o.Paginate {
+		items, count := o.pageKeys()
+		if items == count {
+			return errors.New("page items and count keys are both %q", items)
+		}
+		if o.EmitPresenceMask && (items == presenceMaskName || count == presenceMaskName) {
+			return errors.New("page key %q is the name of the presence mask", presenceMaskName)
+		}
+	}
+	if xt := o.EnumNameExtension; xt != nil {
+		xd := xt.TypeDescriptor()
+		if xd.ContainingMessage().FullName() != enumValueOptionsFullName || xd.Kind() != protoreflect.StringKind || xd.IsList() {
+			return errors.New("%v: enum name extension must be a string field of %v", xd.FullName(), enumValueOptionsFullName)
+		}
+	}
+	return nil
+}
+
+// enumValueOptionsFullName is the message extended by EnumNameExtension.
+const enumValueOptionsFullName protoreflect.FullName = "google.protobuf.EnumValueOptions"
+
+// prepare validates o and returns it with the defaults filled in, as expected
+// by marshal. Options are prepared once per call, or once per Encoder.
+func (o MarshalOptions) prepare() (MarshalOptions, error) {
+	if err := o.validate(); err != nil {
+		return o, err
+	}
 	if o.Multiline && o.Indent == "" {
 		o.Indent = defaultIndent
 	}
 	if o.Resolver == nil {
 		o.Resolver = protoregistry.GlobalTypes
 	}
+	return o, nil
+}
 
+// marshal is a centralized function that all marshal operations go through.
+// For profiling purposes, avoid changing the name of this function or
+// introducing other code paths for marshal that do not go through this.
+//
+// The options must have been prepared. Only the fields in include are written
+// if it is non-nil, and the well-known types are counted in report if it is
+// non-nil.
+func (o MarshalOptions) marshal(b []byte, m proto.Message, include includeTree, report WKTReport) ([]byte, error) {
 	internalEnc, err := json.NewEncoder(b, o.Indent)
 	if err != nil {
 		return nil, err
@@ -152,22 +447,107 @@ func (o MarshalOptions) marshal(b []byte, m proto.Message) ([]byte, error) {
 	// Treat nil message interface as an empty message,
 	// in which case the output in an empty JSON object.
 	if m == nil {
-		return append(b, '{', '}'), nil
+		return o.wrapRoot(b, o.appendEmpty(b)), nil
 	}
 
-	enc := encoder{internalEnc, o}
-	if err := enc.marshalMessage(m.ProtoReflect(), ""); err != nil {
+	internalEnc.SetAllowLineSeparators(o.AllowLineSeparators)
+	enc := encoder{Encoder: internalEnc, opts: o, include: include, report: report, presence: o.EmitPresenceMask, snakeCase: o.TopLevelSnakeCase}
+	if fd := enc.pageField(m.ProtoReflect().Descriptor()); fd != nil {
+		err = enc.marshalPage(m.ProtoReflect(), fd)
+	} else {
+		err = enc.marshalMessage(m.ProtoReflect(), "")
+	}
+	if err != nil {
 		return nil, err
 	}
+	out := enc.Bytes()
+	if o.EmptyTemplate != "" && string(out[len(b):]) == "{}" {
+		out = o.appendEmpty(b)
+	}
+	out = o.wrapRoot(b, out)
 	if o.AllowPartial {
-		return enc.Bytes(), nil
+		return out, nil
 	}
-	return enc.Bytes(), proto.CheckInitialized(m)
+	return out, proto.CheckInitialized(m)
+}
+
+// wrapRoot nests the message written to out after the prefix b under
+// RootKey, if set.
+func (o MarshalOptions) wrapRoot(b, out []byte) []byte {
+	if o.RootKey == "" {
+		return out
+	}
+	msg := append([]byte(nil), out[len(b):]...)
+	// Neither can fail, as the indent is validated and msg is our own output.
+	enc, _ := json.NewEncoder(b, o.Indent)
+	enc.StartObject()
+	enc.WriteName(o.RootKey)
+	enc.WriteRawValue(msg)
+	enc.EndObject()
+	return enc.Bytes()
+}
+
+// appendEmpty appends the output for an empty message to b: EmptyTemplate if
+// set, or else an empty JSON object.
+func (o MarshalOptions) appendEmpty(b []byte) []byte {
+	if o.EmptyTemplate == "" {
+		return append(b, '{', '}')
+	}
+	// Neither can fail, as the indent and the template are validated.
+	enc, _ := json.NewEncoder(b, o.Indent)
+	enc.WriteRawValue([]byte(o.EmptyTemplate))
+	return enc.Bytes()
+}
+
+// Encoder encodes protocol buffer messages in the JSON format. Unlike JSONPb it
+// does not depend on the grpc-gateway runtime, so it can be used on its own.
+type Encoder struct {
+	opts MarshalOptions
+}
+
+// NewEncoder returns an Encoder that marshals messages using the given options.
+// It returns an error if the options are invalid.
+func NewEncoder(opts MarshalOptions) (*Encoder, error) {
+	opts, err := opts.prepare()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{opts: opts}, nil
+}
+
+// Encode returns the JSON encoding of m.
+func (e *Encoder) Encode(m proto.Message) ([]byte, error) {
+	return e.opts.marshal(nil, m, nil, nil)
+}
+
+// EncodeAppend appends the JSON encoding of m to b, returning the result.
+func (e *Encoder) EncodeAppend(b []byte, m proto.Message) ([]byte, error) {
+	return e.opts.marshal(b, m, nil, nil)
 }
 
 type encoder struct {
 	*json.Encoder
 	opts MarshalOptions
+
+	// include is the subset of fields of the current message to write out.
+	// If nil, all fields are written.
+	include includeTree
+
+	// report, if non-nil, counts the well-known types encountered, as for
+	// MarshalReport.
+	report WKTReport
+
+	// presence makes marshalMessage write the presence mask of the message,
+	// as enabled by EmitPresenceMask. It is only set for the top-level message.
+	presence bool
+
+	// snakeCase writes member names in snake_case, as enabled by
+	// TopLevelSnakeCase. It is only set for the top-level value.
+	snakeCase bool
+
+	// path is the location of the current value, as passed to RedactFunc. It
+	// is only kept up to date if RedactFunc is set.
+	path string
 }
 
 // unpopulatedFieldRanger wraps a protoreflect.Message and modifies its Range
@@ -185,7 +565,10 @@ func (m unpopulatedFieldRanger) Range(f func(protoreflect.FieldDescriptor, proto
 		v := m.Get(fd)
 		isProto2Scalar := fd.Syntax() == protoreflect.Proto2 && fd.Default().IsValid()
 		isSingularMessage := fd.Cardinality() != protoreflect.Repeated && fd.Message() != nil
-		if isProto2Scalar || isSingularMessage {
+		switch {
+		case isSingularMessage && isWrapperType(fd.Message().FullName()):
+			v = m.NewField(fd) // use an empty wrapper to emit its zero value
+		case isProto2Scalar || isSingularMessage:
 			v = protoreflect.Value{} // use invalid value to emit null
 		}
 		if !f(fd, v) {
@@ -203,40 +586,359 @@ func (e encoder) marshalMessage(m protoreflect.Message, typeURL string) error {
 		return errors.New("no support for proto1 MessageSets")
 	}
 
-	if marshal := wellKnownTypeMarshaler(m.Descriptor().FullName()); marshal != nil {
+	if marshal := e.wellKnownTypeMarshaler(m.Descriptor().FullName()); marshal != nil {
 		return marshal(e, m)
 	}
 
 	e.StartObject()
 	defer e.EndObject()
 
+	md := m.Descriptor()
+	var n int
+	if typeURL != "" {
+		// Marshal out @type field.
+		e.WriteName("@type")
+		if err := e.WriteString(typeURL); err != nil {
+			return err
+		}
+		if err := e.writeAnyDiscriminator(md); err != nil {
+			return err
+		}
+		if n = e.anyHeaderLen(); e.tooManyFields(n) {
+			return e.maxFieldsError(md)
+		}
+	}
+	n, err := e.marshalFields(m, nil, n)
+	if err != nil {
+		return err
+	}
+	if n, err = e.marshalOneofDiscriminators(m, n); err != nil {
+		return err
+	}
+	if e.presence {
+		if e.tooManyFields(n + 1) {
+			return e.maxFieldsError(md)
+		}
+		if err := e.WriteName(presenceMaskName); err != nil {
+			return err
+		}
+		return e.marshalPresenceMask(m, e.include, nil)
+	}
+	return nil
+}
+
+// anyHeaderLen returns the number of members written for an Any before the
+// fields of the message it embeds or its value member: "@type", and the
+// discriminator if DiscriminatorKey is set.
+func (e encoder) anyHeaderLen() int {
+	if e.opts.DiscriminatorKey != "" {
+		return 2
+	}
+	return 1
+}
+
+// tooManyFields reports whether n members exceed MaxFields.
+func (e encoder) tooManyFields(n int) bool {
+	return e.opts.MaxFields > 0 && n > e.opts.MaxFields
+}
+
+// maxFieldsError returns the error for an object written for a message of
+// type md with more members than MaxFields.
+func (e encoder) maxFieldsError(md protoreflect.MessageDescriptor) error {
+	return errors.New("%v: more than %d fields", md.FullName(), e.opts.MaxFields)
+}
+
+// writeAnyDiscriminator writes the DiscriminatorKey member of an Any holding
+// a message of type md, next to the @type member and either the fields of md
+// or, for well-known types, the value member.
+func (e encoder) writeAnyDiscriminator(md protoreflect.MessageDescriptor) error {
+	key, err := e.anyDiscriminator(md)
+	if key == "" || err != nil {
+		return err
+	}
+	if err := e.WriteName(key); err != nil {
+		return err
+	}
+	return e.WriteString(string(md.FullName()))
+}
+
+// anyDiscriminator returns the name of the member written by
+// writeAnyDiscriminator, or "" if there is none.
+func (e encoder) anyDiscriminator(md protoreflect.MessageDescriptor) (string, error) {
+	key := e.opts.DiscriminatorKey
+	if key == "" {
+		return "", nil
+	}
+	if isWellKnown(md.FullName()) {
+		if key == "@type" || key == "value" {
+			return "", errors.New("%v: discriminator %q collides with a member of the Any", md.FullName(), key)
+		}
+	} else if err := e.checkDiscriminator(md, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// checkDiscriminator reports an error if the name of a discriminator member
+// written for a message of type md is also that of one of its fields, or of
+// the @type member or the presence mask.
+func (e encoder) checkDiscriminator(md protoreflect.MessageDescriptor, name string) error {
+	if name == "@type" || name == presenceMaskName {
+		return errors.New("%v: discriminator %q collides with the %s member", md.FullName(), name, name)
+	}
+	fds := md.Fields()
+	for i := 0; i < fds.Len(); i++ {
+		if fd := fds.Get(i); e.fieldName(fd) == name {
+			return errors.New("%v: discriminator %q collides with field %v", md.FullName(), name, fd.Name())
+		}
+	}
+	return nil
+}
+
+// marshalOneofDiscriminators writes a discriminator member for every populated
+// oneof of m, holding the name of the field that is set. n is the number of
+// members already written for m, for MaxFields; the number after the
+// discriminators is returned.
+func (e encoder) marshalOneofDiscriminators(m protoreflect.Message, n int) (int, error) {
+	return e.rangeOneofDiscriminators(m, n, func(name string, fd protoreflect.FieldDescriptor) error {
+		if err := e.WriteName(name); err != nil {
+			return err
+		}
+		return e.WriteString(e.fieldName(fd))
+	})
+}
+
+// rangeOneofDiscriminators calls f with the name of every discriminator member
+// that marshalOneofDiscriminators writes and the field it names, stopping at
+// the first error. n is as for marshalOneofDiscriminators.
+func (e encoder) rangeOneofDiscriminators(m protoreflect.Message, n int, f func(name string, fd protoreflect.FieldDescriptor) error) (int, error) {
+	if e.opts.DiscriminatorKey == "" {
+		return n, nil
+	}
+	md := m.Descriptor()
+	ods := md.Oneofs()
+	for i := 0; i < ods.Len(); i++ {
+		od := ods.Get(i)
+		if od.IsSynthetic() {
+			continue
+		}
+		fd := m.WhichOneof(od)
+		if fd == nil {
+			continue
+		}
+		if e.include != nil {
+			if _, ok := e.include[fd.Number()]; !ok {
+				continue
+			}
+		}
+		name := string(od.Name()) + "_" + e.opts.DiscriminatorKey
+		if !e.opts.UseProtoNames {
+			name = e.memberName(JSONCamelCase(name))
+		}
+		if err := e.checkDiscriminator(md, name); err != nil {
+			return n, err
+		}
+		if n++; e.tooManyFields(n) {
+			return n, e.maxFieldsError(md)
+		}
+		if err := f(name, fd); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// presenceMaskName is the name of the member written with EmitPresenceMask.
+const presenceMaskName = "_fieldMask"
+
+// marshalPresenceMask writes an object mapping the name of every field of m
+// selected by include to whether the field is populated. Populated message
+// fields map to the presence mask of their value instead, except for
+// well-known types. The field items, if non-nil, is named after the items of
+// the envelope written with Paginate.
+func (e encoder) marshalPresenceMask(m protoreflect.Message, include includeTree, items protoreflect.FieldDescriptor) error {
+	e.StartObject()
+	defer e.EndObject()
+
+	fds := m.Descriptor().Fields()
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		sub := include
+		if include != nil {
+			var ok bool
+			if sub, ok = include[fd.Number()]; !ok {
+				continue
+			}
+		}
+
+		name := e.fieldName(fd)
+		if fd == items {
+			name, _ = e.opts.pageKeys()
+		}
+		if err := e.WriteName(name); err != nil {
+			return err
+		}
+		if md := fd.Message(); md != nil && fd.Cardinality() != protoreflect.Repeated && !isWellKnown(md.FullName()) && m.Has(fd) {
+			se := e
+			se.snakeCase = false
+			if err := se.marshalPresenceMask(m.Get(fd).Message(), sub, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		e.WriteBool(m.Has(fd))
+	}
+	return nil
+}
+
+// marshalFields writes the fields of m as members of the current JSON object,
+// leaving out the field skip if it is non-nil. n is the number of members
+// already written for m, for MaxFields; the number after the fields is
+// returned.
+func (e encoder) marshalFields(m protoreflect.Message, skip protoreflect.FieldDescriptor, n int) (int, error) {
+	return e.rangeFields(m, skip, n, func(fe encoder, fd protoreflect.FieldDescriptor, v protoreflect.Value, name string) error {
+		if err := e.WriteName(name); err != nil {
+			return err
+		}
+		if err := fe.marshalValue(v, fd); err != nil {
+			return fieldError(err, name)
+		}
+		return nil
+	})
+}
+
+// rangeFields calls f for the fields of m that marshalFields writes, in order,
+// with the encoder for the value and the name of the member. It stops at the
+// first error, which it returns. n is as for marshalFields.
+func (e encoder) rangeFields(m protoreflect.Message, skip protoreflect.FieldDescriptor, n int,
+	f func(fe encoder, fd protoreflect.FieldDescriptor, v protoreflect.Value, name string) error) (int, error) {
 	var fields order.FieldRanger = m
 	if e.opts.EmitUnpopulated {
 		fields = unpopulatedFieldRanger{m}
 	}
 
 	var err error
-	order.RangeFields(fields, order.IndexNameFieldOrder, func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
-		name := fd.JSONName()
-		if e.opts.UseProtoNames {
-			name = fd.TextName()
+	order.RangeFields(fields, e.fieldOrder(), func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd == skip {
+			return true
 		}
-
-		if err = e.WriteName(name); err != nil {
-			return false
+		fe := e
+		fe.presence, fe.snakeCase = false, false
+		if e.include != nil {
+			sub, ok := e.include[fd.Number()]
+			if !ok {
+				return true
+			}
+			fe.include = sub
 		}
-		if err = e.marshalValue(v, fd); err != nil {
+		if n++; e.tooManyFields(n) {
+			err = e.maxFieldsError(m.Descriptor())
 			return false
 		}
-		return true
+
+		name := e.fieldName(fd)
+		if e.opts.RedactFunc != nil {
+			fe.path = e.fieldPath(name)
+		}
+		err = f(fe, fd, v, name)
+		return err == nil
 	})
-	return err
+	return n, err
+}
+
+// fieldName returns the name of the member written for the field fd.
+func (e encoder) fieldName(fd protoreflect.FieldDescriptor) string {
+	if e.opts.UseProtoNames {
+		return fd.TextName()
+	}
+	return e.memberName(fd.JSONName())
+}
+
+// memberName returns the name written for the member name, in snake_case if
+// snakeCase is set.
+func (e encoder) memberName(name string) string {
+	if !e.snakeCase {
+		return name
+	}
+	return JSONSnakeCase(lowerCamelCase(name))
+}
+
+// fieldPath returns the path of the member name of the current object.
+func (e encoder) fieldPath(name string) string {
+	if e.path == "" {
+		return name
+	}
+	return e.path + "." + name
+}
+
+// elemPath returns the path of the element with the index or map key k of the
+// current array or object.
+func (e encoder) elemPath(k string) string {
+	return e.path + "[" + k + "]"
+}
+
+// FieldPathError is the error returned when marshaling a value fails, locating
+// the value from the top-level message with a path in the form passed to
+// RedactFunc.
+type FieldPathError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldPathError) Error() string {
+	return errors.New("%s: %v", e.Path, e.Err).Error()
+}
+
+func (e *FieldPathError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError locates err at the member name of the current object.
+func fieldError(err error, name string) error {
+	pe, ok := err.(*FieldPathError)
+	if !ok {
+		return &FieldPathError{Path: name, Err: err}
+	}
+	if strings.HasPrefix(pe.Path, "[") {
+		pe.Path = name + pe.Path
+	} else {
+		pe.Path = name + "." + pe.Path
+	}
+	return pe
+}
+
+// elemError locates err at the element with the index or map key k of the
+// current array or object.
+func elemError(err error, k string) error {
+	pe, ok := err.(*FieldPathError)
+	if !ok {
+		return &FieldPathError{Path: "[" + k + "]", Err: err}
+	}
+	if strings.HasPrefix(pe.Path, "[") {
+		pe.Path = "[" + k + "]" + pe.Path
+	} else {
+		pe.Path = "[" + k + "]." + pe.Path
+	}
+	return pe
+}
+
+// fieldOrder returns the order in which the fields of a message are written.
+func (e encoder) fieldOrder() order.FieldOrder {
+	if !e.opts.Stable {
+		return order.IndexNameFieldOrder
+	}
+	return func(x, y protoreflect.FieldDescriptor) bool {
+		return e.fieldName(x) < e.fieldName(y)
+	}
 }
 
 // marshalValue marshals the given protoreflect.Value.
 func (e encoder) marshalValue(val protoreflect.Value, fd protoreflect.FieldDescriptor) error {
 	switch {
 	case fd.IsList():
+		if e.opts.SparseRepeated && fd.Message() == nil && isSparseList(val.List(), fd) {
+			return e.marshalSparseList(val.List(), fd)
+		}
 		return e.marshalList(val.List(), fd)
 	case fd.IsMap():
 		return e.marshalMap(val.Map(), fd)
@@ -253,6 +955,29 @@ func (e encoder) marshalSingular(val protoreflect.Value, fd protoreflect.FieldDe
 		return nil
 	}
 
+	if e.opts.RedactFunc != nil && fd.Message() == nil {
+		if redact, s := e.opts.RedactFunc(e.path, val); redact {
+			return e.WriteString(s)
+		}
+	}
+
+	if kind := fd.Kind(); e.opts.RejectNonFinite && (kind == protoreflect.FloatKind || kind == protoreflect.DoubleKind) {
+		if v := val.Float(); math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("%s: invalid %v value", fd.FullName(), v)
+		}
+	}
+
+	if format := e.opts.NumberFormatter; format != nil && isNumberKind(fd.Kind()) {
+		s, err := format(fd, val)
+		if err != nil {
+			return err
+		}
+		if !isJSONNumberOrString(s) || e.WriteRawValue([]byte(s)) != nil {
+			return errors.New("%v: number formatter returned %q, which is not a JSON number or string", fd.FullName(), s)
+		}
+		return nil
+	}
+
 	switch kind := fd.Kind(); kind {
 	case protoreflect.BoolKind:
 		e.WriteBool(val.Bool())
@@ -269,22 +994,43 @@ func (e encoder) marshalSingular(val protoreflect.Value, fd protoreflect.FieldDe
 		e.WriteUint(val.Uint())
 
 	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
-		// signed 64-bit integers are written out as int64.
-		e.WriteInt(val.Int())
+		// signed 64-bit integers are written out as int64, or as a JSON
+		// string under Int64AsString.
+		if e.opts.Int64AsString {
+			e.WriteString(strconv.FormatInt(val.Int(), 10))
+		} else {
+			e.WriteInt(val.Int())
+		}
 
 	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
-		// unsigned 64-bit integers are written out as uint64.
-		e.WriteUint(val.Uint())
-
-	case protoreflect.FloatKind:
-		// Encoder.WriteFloat handles the special numbers NaN and infinites.
-		e.WriteFloat(val.Float(), 32)
+		// unsigned 64-bit integers are written out as uint64, or as a JSON
+		// string under Int64AsString.
+		if e.opts.Int64AsString {
+			e.WriteString(strconv.FormatUint(val.Uint(), 10))
+		} else {
+			e.WriteUint(val.Uint())
+		}
 
-	case protoreflect.DoubleKind:
-		// Encoder.WriteFloat handles the special numbers NaN and infinites.
-		e.WriteFloat(val.Float(), 64)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		// Encoder.WriteFloat writes the special numbers NaN and infinites as
+		// the strings "NaN", "Infinity" and "-Infinity".
+		v := val.Float()
+		bitSize := 64
+		if kind == protoreflect.FloatKind {
+			bitSize = 32
+		}
+		e.writeFloat(v, bitSize)
 
 	case protoreflect.BytesKind:
+		if e.opts.BytesWithLength {
+			e.StartObject()
+			e.WriteName("b64")
+			e.WriteString(base64.StdEncoding.EncodeToString(val.Bytes()))
+			e.WriteName("len")
+			e.WriteInt(int64(len(val.Bytes())))
+			e.EndObject()
+			break
+		}
 		e.WriteString(base64.StdEncoding.EncodeToString(val.Bytes()))
 
 	case protoreflect.EnumKind:
@@ -294,8 +1040,10 @@ func (e encoder) marshalSingular(val protoreflect.Value, fd protoreflect.FieldDe
 			desc := fd.Enum().Values().ByNumber(val.Enum())
 			if e.opts.UseEnumNumbers || desc == nil {
 				e.WriteInt(int64(val.Enum()))
+			} else if e.opts.EmptyZeroEnums && val.Enum() == 0 {
+				e.WriteString("")
 			} else {
-				e.WriteString(string(desc.Name()))
+				e.WriteString(e.enumName(desc))
 			}
 		}
 
@@ -310,6 +1058,83 @@ func (e encoder) marshalSingular(val protoreflect.Value, fd protoreflect.FieldDe
 	return nil
 }
 
+// enumName returns the name to write for the enum value desc: the alias set
+// with the EnumNameExtension option, if any, or else its proto name.
+func (e encoder) enumName(desc protoreflect.EnumValueDescriptor) string {
+	if xt := e.opts.EnumNameExtension; xt != nil {
+		if opts := desc.Options(); proto.HasExtension(opts, xt) {
+			if alias, _ := proto.GetExtension(opts, xt).(string); alias != "" {
+				return alias
+			}
+		}
+	}
+	return string(desc.Name())
+}
+
+// NumberFormatter formats the value v of a numeric field fd, that is, any
+// integer, float or double field, as JSON text. It may return a string for
+// display, such as "\"1,234\"", but must return a JSON number or string. It
+// is not called for the values rejected by RejectNonFinite.
+type NumberFormatter func(fd protoreflect.FieldDescriptor, v protoreflect.Value) (string, error)
+
+// SpecNumberFormatter is a NumberFormatter that follows the proto3 JSON
+// mapping: 64-bit integers are written as strings, and so are the special
+// float values "NaN", "Infinity" and "-Infinity". Other numbers are written as
+// JSON numbers. Custom formatters can fall back to it.
+func SpecNumberFormatter(fd protoreflect.FieldDescriptor, v protoreflect.Value) (string, error) {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.Quote(strconv.FormatInt(v.Int(), 10)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.Quote(strconv.FormatUint(v.Uint(), 10)), nil
+	case protoreflect.FloatKind:
+		enc, _ := json.NewEncoder(nil, "")
+		enc.WriteFloat(v.Float(), 32)
+		return string(enc.Bytes()), nil
+	case protoreflect.DoubleKind:
+		enc, _ := json.NewEncoder(nil, "")
+		enc.WriteFloat(v.Float(), 64)
+		return string(enc.Bytes()), nil
+	}
+	return "", errors.New("%v: not a number field", fd.FullName())
+}
+
+// isJSONNumberOrString reports whether s is a single JSON number or string,
+// without surrounding whitespace.
+func isJSONNumberOrString(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s || !stdjson.Valid([]byte(s)) {
+		return false
+	}
+	return s[0] == '"' || s[0] == '-' || '0' <= s[0] && s[0] <= '9'
+}
+
+// isNumberKind reports whether fields of the kind are formatted by the
+// NumberFormatter.
+func isNumberKind(kind protoreflect.Kind) bool {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind,
+		protoreflect.FloatKind, protoreflect.DoubleKind:
+		return true
+	}
+	return false
+}
+
+// writeFloat writes out a float or double value according to the options.
+func (e encoder) writeFloat(n float64, bitSize int) {
+	if e.opts.EmitFloatDecimal {
+		e.WriteFloatDecimal(n, bitSize)
+		return
+	}
+	e.WriteFloat(n, bitSize)
+}
+
 // marshalList marshals the given protoreflect.List.
 func (e encoder) marshalList(list protoreflect.List, fd protoreflect.FieldDescriptor) error {
 	e.StartArray()
@@ -317,8 +1142,75 @@ func (e encoder) marshalList(list protoreflect.List, fd protoreflect.FieldDescri
 
 	for i := 0; i < list.Len(); i++ {
 		item := list.Get(i)
-		if err := e.marshalSingular(item, fd); err != nil {
-			return err
+		ie := e
+		if e.opts.RedactFunc != nil {
+			ie.path = e.elemPath(strconv.Itoa(i))
+		}
+		if err := ie.marshalSingular(item, fd); err != nil {
+			return elemError(err, strconv.Itoa(i))
+		}
+	}
+	return nil
+}
+
+// isSparseList reports whether the list of scalars is better written in its
+// index-sparse form.
+func isSparseList(list protoreflect.List, fd protoreflect.FieldDescriptor) bool {
+	n := list.Len()
+	if n == 0 || isZeroScalar(list.Get(n-1), fd.Kind()) {
+		return false
+	}
+	var set int
+	for i := 0; i < n; i++ {
+		if !isZeroScalar(list.Get(i), fd.Kind()) {
+			set++
+		}
+	}
+	return set*2 < n
+}
+
+// isZeroScalar reports whether v is the zero value of a scalar of the given
+// kind. Negative zero is not considered zero so that it survives a round-trip.
+func isZeroScalar(v protoreflect.Value, kind protoreflect.Kind) bool {
+	switch kind {
+	case protoreflect.BoolKind:
+		return !v.Bool()
+	case protoreflect.EnumKind:
+		return v.Enum() == 0
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int() == 0
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint() == 0
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return math.Float64bits(v.Float()) == 0
+	case protoreflect.StringKind:
+		return v.String() == ""
+	case protoreflect.BytesKind:
+		return len(v.Bytes()) == 0
+	}
+	return false
+}
+
+// marshalSparseList marshals the non-zero elements of the given
+// protoreflect.List as a JSON object keyed by their index.
+func (e encoder) marshalSparseList(list protoreflect.List, fd protoreflect.FieldDescriptor) error {
+	e.StartObject()
+	defer e.EndObject()
+
+	for i := 0; i < list.Len(); i++ {
+		item := list.Get(i)
+		if isZeroScalar(item, fd.Kind()) {
+			continue
+		}
+		ie := e
+		if e.opts.RedactFunc != nil {
+			ie.path = e.elemPath(strconv.Itoa(i))
+		}
+		e.WriteName(strconv.Itoa(i))
+		if err := ie.marshalSingular(item, fd); err != nil {
+			return elemError(err, strconv.Itoa(i))
 		}
 	}
 	return nil
@@ -326,16 +1218,62 @@ func (e encoder) marshalList(list protoreflect.List, fd protoreflect.FieldDescri
 
 // marshalMap marshals given protoreflect.Map.
 func (e encoder) marshalMap(mmap protoreflect.Map, fd protoreflect.FieldDescriptor) error {
+	if e.opts.MaxFields > 0 && mmap.Len() > e.opts.MaxFields {
+		return errors.New("%v: more than %d entries", fd.FullName(), e.opts.MaxFields)
+	}
+
 	e.StartObject()
 	defer e.EndObject()
 
+	return e.rangeMapEntries(mmap, fd, func(ve encoder, k protoreflect.MapKey, v protoreflect.Value, name string) error {
+		if err := e.WriteName(name); err != nil {
+			return err
+		}
+		if err := ve.marshalSingular(v, fd.MapValue()); err != nil {
+			return elemError(err, k.String())
+		}
+		return nil
+	})
+}
+
+// rangeMapEntries calls f for the members that marshalMap writes for mmap, in
+// order, with the encoder for the value, the key of the entry and the name of
+// the member. It stops at the first error, which it returns.
+func (e encoder) rangeMapEntries(mmap protoreflect.Map, fd protoreflect.FieldDescriptor,
+	f func(ve encoder, k protoreflect.MapKey, v protoreflect.Value, name string) error) error {
+	namedKeys := fd.MapKey().Kind() == protoreflect.StringKind && fd.FullName() != genid.Struct_Fields_field_fullname
+	dual := e.opts.DualMapKeys && namedKeys
+	camelCase := e.opts.CamelCaseMapKeys && namedKeys && !dual
+
+	// aliases holds the lowerCamelCase keys written with DualMapKeys.
+	var aliases map[string]bool
+	if dual {
+		aliases = map[string]bool{}
+	}
+
 	var err error
+	var n int
 	order.RangeEntries(mmap, order.GenericKeyOrder, func(k protoreflect.MapKey, v protoreflect.Value) bool {
-		if err = e.WriteName(k.String()); err != nil {
-			return false
+		names := []string{k.String()}
+		if camelCase {
+			names[0] = JSONCamelCase(names[0])
 		}
-		if err = e.marshalSingular(v, fd.MapValue()); err != nil {
-			return false
+		if alias := JSONCamelCase(k.String()); dual && alias != k.String() && !aliases[alias] && !mmap.Has(protoreflect.ValueOfString(alias).MapKey()) {
+			aliases[alias] = true
+			names = append(names, alias)
+		}
+		ve := e
+		if e.opts.RedactFunc != nil {
+			ve.path = e.elemPath(k.String())
+		}
+		for _, name := range names {
+			if n++; e.opts.MaxFields > 0 && n > e.opts.MaxFields {
+				err = errors.New("%v: more than %d entries", fd.FullName(), e.opts.MaxFields)
+				return false
+			}
+			if err = f(ve, k, v, name); err != nil {
+				return false
+			}
 		}
 		return true
 	})
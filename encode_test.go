@@ -0,0 +1,603 @@
+package jsonpb
+
+import (
+	"crypto/sha256"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestMarshalIntegralFloat(t *testing.T) {
+	st, err := structpb.NewStruct(map[string]interface{}{"n": 5.0, "f": 1.5, "e": 1e21})
+	require.NoError(t, err)
+
+	actual, err := Marshal(st)
+	require.NoError(t, err)
+	require.Equal(t, `{"e":1e+21,"f":1.5,"n":5}`, string(actual))
+
+	actual, err = MarshalOptions{EmitFloatDecimal: true}.Marshal(st)
+	require.NoError(t, err)
+	require.Equal(t, `{"e":1e+21,"f":1.5,"n":5.0}`, string(actual))
+
+	actual, err = MarshalOptions{EmitFloatDecimal: true}.Marshal(wrapperspb.Float(-2))
+	require.NoError(t, err)
+	require.Equal(t, `-2.0`, string(actual))
+
+	m := newMessage(t, sampleType, `{"ratio":3,"values":[1,0.25,"NaN"]}`)
+	actual, err = MarshalOptions{EmitFloatDecimal: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"ratio":3.0,"values":[1.0,0.25,"NaN"]}`, string(actual))
+}
+
+func TestEncoder(t *testing.T) {
+	enc, err := NewEncoder(MarshalOptions{UseProtoNames: true})
+	require.NoError(t, err)
+
+	m := newMessage(t, sampleType, `{"id":"a","managerId":"18014398509481984","nested":{"name":"n"}}`)
+	actual, err := enc.Encode(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a","manager_id":18014398509481984,"nested":{"name":"n"}}`, string(actual))
+
+	// The encoder is reusable and produces the same output as JSONPb.
+	again, err := enc.Encode(m)
+	require.NoError(t, err)
+	require.Equal(t, actual, again)
+
+	viaJSONPb, err := (&JSONPb{MarshalOptions: MarshalOptions{UseProtoNames: true}}).Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, actual, viaJSONPb)
+
+	actual, err = enc.Encode(nil)
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(actual))
+}
+
+func TestNewEncoderInvalidOptions(t *testing.T) {
+	_, err := NewEncoder(MarshalOptions{Indent: "--"})
+	require.Error(t, err)
+}
+
+func TestEmitUnpopulated(t *testing.T) {
+	m := newMessage(t, sampleType, `{"alias":"","tags":["a"],"counts":{"k":"0"}}`)
+
+	actual, err := Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"tags":["a"],"counts":{"k":0},"alias":""}`, string(actual))
+
+	// Unset oneof and proto3 optional fields are skipped, unset message fields
+	// are null, except for wrappers, and everything else has its zero value.
+	actual, err = MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"","managerId":0,"big":0,"small":0,"flag":false,"ratio":0,"score":0,"data":"",`+
+		`"color":"COLOR_UNSPECIFIED","tags":["a"],"values":[],"counts":{"k":0},"nested":null,"children":[],`+
+		`"createdAt":null,"ttl":null,"alias":"","extra":null,"attrs":null,"mask":null,"labels":{},"colors":[],`+
+		`"enabled":false}`, string(actual))
+
+	// Unset wrappers are written as their primitive zero value.
+	actual, err = MarshalOptions{EmitUnpopulated: true}.Marshal(sampleType.New().Interface())
+	require.NoError(t, err)
+	require.Contains(t, string(actual), `"alias":"",`)
+	require.Contains(t, string(actual), `"enabled":false}`)
+
+	// Set oneof and optional fields are emitted as usual.
+	m = newMessage(t, nestedType, `{}`)
+	actual, err = MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"","count":0,"child":null}`, string(actual))
+
+	m = newMessage(t, sampleType, `{"number":"0","nickname":""}`)
+	actual, err = MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Contains(t, string(actual), `"number":0,`)
+	require.Contains(t, string(actual), `"nickname":"",`)
+	require.NotContains(t, string(actual), `"text"`)
+}
+
+func TestUseProtoNames(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"managerId": "1",
+		"counts": {"someKey": "2"},
+		"nested": {"child": {"name": "c"}},
+		"createdAt": "2023-08-29T00:00:00Z",
+		"extra": {"@type": "type.googleapis.com/google.protobuf.Duration", "value": "1s"},
+		"mask": "createdAt,nested.childName"
+	}`)
+
+	actual, err := MarshalOptions{UseProtoNames: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"manager_id":1,"counts":{"someKey":2},"nested":{"child":{"name":"c"}},`+
+		`"created_at":"2023-08-29T00:00:00Z",`+
+		`"extra":{"@type":"type.googleapis.com/google.protobuf.Duration","value":"1s"},`+
+		`"mask":"createdAt,nested.childName"}`, string(actual))
+
+	// protojson accepts the proto names as well.
+	got := sampleType.New().Interface()
+	require.NoError(t, protojson.Unmarshal(actual, got))
+	require.True(t, proto.Equal(m, got), "got %v", got)
+}
+
+func TestMarshalReport(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"createdAt": "2023-08-29T00:00:00Z",
+		"ttl": "1s",
+		"extra": {"@type": "type.googleapis.com/google.protobuf.Duration", "value": "2s"},
+		"nested": {"name": "not well-known"}
+	}`)
+
+	report, err := MarshalOptions{}.MarshalReport(m)
+	require.NoError(t, err)
+	require.Equal(t, WKTReport{
+		"google.protobuf.Timestamp": 1,
+		"google.protobuf.Duration":  2,
+		"google.protobuf.Any":       1,
+	}, report)
+
+	st, err := structpb.NewStruct(map[string]interface{}{"list": []interface{}{1, "a"}})
+	require.NoError(t, err)
+	report, err = MarshalOptions{}.MarshalReport(st)
+	require.NoError(t, err)
+	require.Equal(t, WKTReport{
+		"google.protobuf.Struct":    1,
+		"google.protobuf.Value":     3,
+		"google.protobuf.ListValue": 1,
+	}, report)
+}
+
+func TestEmptyZeroEnums(t *testing.T) {
+	m := newMessage(t, sampleType, `{"colors":["COLOR_UNSPECIFIED","RED"]}`)
+
+	actual, err := MarshalOptions{EmptyZeroEnums: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"colors":["","RED"]}`, string(actual))
+
+	actual, err = MarshalOptions{EmitUnpopulated: true, EmptyZeroEnums: true}.MarshalInclude(m, []string{"color"})
+	require.NoError(t, err)
+	require.Equal(t, `{"color":""}`, string(actual))
+
+	actual, err = MarshalOptions{EmitUnpopulated: true}.MarshalInclude(m, []string{"color"})
+	require.NoError(t, err)
+	require.Equal(t, `{"color":"COLOR_UNSPECIFIED"}`, string(actual))
+
+	actual, err = MarshalOptions{EmitUnpopulated: true, EmptyZeroEnums: true, UseEnumNumbers: true}.MarshalInclude(m, []string{"color"})
+	require.NoError(t, err)
+	require.Equal(t, `{"color":0}`, string(actual))
+}
+
+func TestInt64AsString(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"managerId": "18014398509481984",
+		"big": "18446744073709551615",
+		"small": 7,
+		"counts": {"k": "-1"},
+		"number": "3",
+		"labels": {"5": "five"}
+	}`)
+
+	actual, err := Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"managerId":18014398509481984,"big":18446744073709551615,"small":7,"counts":{"k":-1},`+
+		`"number":3,"labels":{"5":"five"}}`, string(actual))
+
+	actual, err = MarshalOptions{Int64AsString: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"managerId":"18014398509481984","big":"18446744073709551615","small":7,"counts":{"k":"-1"},`+
+		`"number":"3","labels":{"5":"five"}}`, string(actual))
+
+	actual, err = MarshalOptions{Int64AsString: true}.Marshal(wrapperspb.UInt64(1 << 60))
+	require.NoError(t, err)
+	require.Equal(t, `"1152921504606846976"`, string(actual))
+}
+
+func TestEmptyTemplate(t *testing.T) {
+	opts := MarshalOptions{EmptyTemplate: `{"data": {}, "meta": {}}`}
+
+	actual, err := opts.Marshal(sampleType.New().Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"data":{},"meta":{}}`, string(actual))
+
+	actual, err = opts.Marshal(nil)
+	require.NoError(t, err)
+	require.Equal(t, `{"data":{},"meta":{}}`, string(actual))
+
+	actual, err = opts.Marshal(newMessage(t, sampleType, `{"id":"a"}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a"}`, string(actual))
+
+	opts.Indent = "  "
+	actual, err = opts.Marshal(sampleType.New().Interface())
+	require.NoError(t, err)
+	require.Equal(t, "{\n  \"data\": {},\n  \"meta\": {}\n}", string(actual))
+
+	_, err = MarshalOptions{EmptyTemplate: `{"data":`}.Marshal(sampleType.New().Interface())
+	require.Error(t, err)
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`{"ratio":"NaN"}`, `{"ratio":"NaN"}`},
+		{`{"ratio":"Infinity"}`, `{"ratio":"Infinity"}`},
+		{`{"score":"-Infinity"}`, `{"score":"-Infinity"}`},
+		{`{"values":[1,"NaN","Infinity","-Infinity"]}`, `{"values":[1,"NaN","Infinity","-Infinity"]}`},
+	}
+	for _, tt := range tests {
+		m := newMessage(t, sampleType, tt.src)
+		actual, err := Marshal(m)
+		require.NoError(t, err, tt.src)
+		require.Equal(t, tt.want, string(actual), tt.src)
+
+		// The output reads back with the upstream decoder.
+		require.NoError(t, protojson.Unmarshal(actual, sampleType.New().Interface()), tt.src)
+
+		_, err = MarshalOptions{RejectNonFinite: true}.Marshal(m)
+		require.Error(t, err, tt.src)
+	}
+
+	_, err := MarshalOptions{RejectNonFinite: true}.Marshal(wrapperspb.Double(math.Inf(1)))
+	require.ErrorContains(t, err, "google.protobuf.DoubleValue.value")
+
+	actual, err := MarshalOptions{RejectNonFinite: true}.Marshal(newMessage(t, sampleType, `{"ratio":1.5,"values":[2]}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"ratio":1.5,"values":[2]}`, string(actual))
+}
+
+func TestPretty(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"id": "a<b>",
+		"managerId": "18014398509481985",
+		"color": "GREEN",
+		"nested": {"name": "n", "count": "2", "child": {"name": "c"}},
+		"createdAt": "2023-08-29T00:00:00.500Z",
+		"attrs": {"z": 1, "a": [true]}
+	}`)
+
+	expected := `{
+  "attrs": {
+    "a": [
+      true
+    ],
+    "z": 1
+  },
+  "color": "GREEN",
+  "createdAt": "2023-08-29T00:00:00.500Z",
+  "id": "a<b>",
+  "managerId": 18014398509481985,
+  "nested": {
+    "child": {
+      "name": "c"
+    },
+    "count": 2,
+    "name": "n"
+  }
+}`
+	actual, err := Pretty(m)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestEmitPresenceMask(t *testing.T) {
+	opts := MarshalOptions{EmitPresenceMask: true}
+	m := newMessage(t, nestedType, `{"name":"n","child":{"count":"2"}}`)
+	actual, err := opts.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"n","child":{"count":2},"_fieldMask":{"name":true,"count":false,"child":{"name":false,"count":true,"child":false}}}`, string(actual))
+
+	m = newMessage(t, sampleType, `{"id":"a","tags":["x"],"nested":{"child":{"name":"c"}},"createdAt":"2023-08-29T00:00:00Z"}`)
+	actual, err = opts.MarshalInclude(m, []string{"id", "managerId", "tags", "nested.child", "createdAt"})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a","tags":["x"],"nested":{"child":{"name":"c"}},"createdAt":"2023-08-29T00:00:00Z",`+
+		`"_fieldMask":{"id":true,"managerId":false,"tags":true,"nested":{"child":{"name":true,"count":false,"child":false}},"createdAt":true}}`,
+		string(actual))
+}
+
+func TestMaxFields(t *testing.T) {
+	st, err := structpb.NewStruct(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	require.NoError(t, err)
+
+	_, err = MarshalOptions{MaxFields: 2}.Marshal(st)
+	require.ErrorContains(t, err, "google.protobuf.Struct.fields")
+
+	actual, err := MarshalOptions{MaxFields: 3}.Marshal(st)
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"b":2,"c":3}`, string(actual))
+
+	m := newMessage(t, sampleType, `{"id":"a","nested":{"name":"n","count":"1","child":{}}}`)
+	_, err = MarshalOptions{MaxFields: 2}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Nested")
+	_, err = MarshalOptions{MaxFields: 2, EmitUnpopulated: true}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Sample")
+	_, err = MarshalOptions{MaxFields: 3}.Marshal(m)
+	require.NoError(t, err)
+
+	// Members other than fields count as well.
+	m = newMessage(t, sampleType, `{"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"n"}}`)
+	_, err = MarshalOptions{MaxFields: 1}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Nested: more than 1 fields")
+	_, err = MarshalOptions{MaxFields: 2}.Marshal(m)
+	require.NoError(t, err)
+	m = newMessage(t, sampleType, `{"extra":{"@type":"type.googleapis.com/google.protobuf.Duration","value":"1s"}}`)
+	_, err = MarshalOptions{MaxFields: 1}.Marshal(m)
+	require.ErrorContains(t, err, "google.protobuf.Any: more than 1 fields")
+	m = newMessage(t, sampleType, `{"id":"a"}`)
+	_, err = MarshalOptions{MaxFields: 1, EmitPresenceMask: true}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Sample: more than 1 fields")
+
+	page := newMessage(t, newPageType(t, "ListTagsResponse"), `{"tags":["a"],"nextPageToken":"t"}`)
+	for _, limit := range []int{1, 2} {
+		opts := MarshalOptions{Paginate: true, MaxFields: limit}
+		_, err = opts.Marshal(page)
+		require.Error(t, err, limit)
+		_, err = opts.EmittedKeys(page)
+		require.Error(t, err, limit)
+	}
+	actual, err = MarshalOptions{Paginate: true, MaxFields: 3}.Marshal(page)
+	require.NoError(t, err)
+	require.Equal(t, `{"items":["a"],"count":1,"nextPageToken":"t"}`, string(actual))
+	_, err = MarshalOptions{Paginate: true, MaxFields: 3, EmitPresenceMask: true}.Marshal(page)
+	require.Error(t, err)
+}
+
+func TestNumberFormatter(t *testing.T) {
+	m := newMessage(t, sampleType, `{"managerId":"1234567","small":-1000,"ratio":1234.5,"values":[1,"NaN"],"counts":{"k":"2000"},"id":"1000"}`)
+
+	thousands := func(fd protoreflect.FieldDescriptor, v protoreflect.Value) (string, error) {
+		if fd.Kind() != protoreflect.Int64Kind && fd.Kind() != protoreflect.Int32Kind {
+			return SpecNumberFormatter(fd, v)
+		}
+		s := strconv.FormatInt(v.Int(), 10)
+		var b []byte
+		for i, c := range []byte(strings.TrimPrefix(s, "-")) {
+			if i > 0 && (len(strings.TrimPrefix(s, "-"))-i)%3 == 0 {
+				b = append(b, ',')
+			}
+			b = append(b, c)
+		}
+		if v.Int() < 0 {
+			b = append([]byte{'-'}, b...)
+		}
+		return strconv.Quote(string(b)), nil
+	}
+	actual, err := MarshalOptions{NumberFormatter: thousands}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"1000","managerId":"1,234,567","small":"-1,000","ratio":1234.5,"values":[1,"NaN"],"counts":{"k":"2,000"}}`, string(actual))
+
+	actual, err = MarshalOptions{NumberFormatter: SpecNumberFormatter}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"1000","managerId":"1234567","small":-1000,"ratio":1234.5,"values":[1,"NaN"],"counts":{"k":"2000"}}`, string(actual))
+	require.NoError(t, protojson.Unmarshal(actual, sampleType.New().Interface()))
+
+	for _, s := range []string{"1,000", `{"x":1}`, "[1]", "true", "null", " 1", ""} {
+		invalid := func(protoreflect.FieldDescriptor, protoreflect.Value) (string, error) { return s, nil }
+		_, err = MarshalOptions{NumberFormatter: invalid}.Marshal(m)
+		require.ErrorContains(t, err, "not a JSON number or string", s)
+	}
+
+	// Non-finite values are rejected before the formatter is called.
+	_, err = MarshalOptions{NumberFormatter: SpecNumberFormatter, RejectNonFinite: true}.Marshal(m)
+	require.ErrorContains(t, err, "invalid NaN value")
+	actual, err = MarshalOptions{NumberFormatter: SpecNumberFormatter, RejectNonFinite: true}.Marshal(newMessage(t, sampleType, `{"values":[1.5]}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"values":[1.5]}`, string(actual))
+}
+
+const testAliasExtProtoFile = `
+name: "jsonpb/alias_ext.proto"
+package: "jsonpb.test.alias"
+syntax: "proto2"
+dependency: "google/protobuf/descriptor.proto"
+extension { name: "json_alias" number: 50001 label: LABEL_OPTIONAL type: TYPE_STRING extendee: ".google.protobuf.EnumValueOptions" }
+extension { name: "json_rank" number: 50002 label: LABEL_OPTIONAL type: TYPE_INT32 extendee: ".google.protobuf.EnumValueOptions" }
+`
+
+const testAliasProtoFile = `
+name: "jsonpb/alias.proto"
+package: "jsonpb.test.alias"
+syntax: "proto3"
+dependency: "jsonpb/alias_ext.proto"
+enum_type {
+  name: "Tier"
+  value { name: "TIER_UNSPECIFIED" number: 0 }
+  value { name: "TIER_GOLD" number: 1 options { [jsonpb.test.alias.json_alias]: "gold" } }
+  value { name: "TIER_SILVER" number: 2 }
+}
+message_type {
+  name: "Account"
+  field { name: "tier" number: 1 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".jsonpb.test.alias.Tier" }
+  field { name: "tiers" number: 2 label: LABEL_REPEATED type: TYPE_ENUM type_name: ".jsonpb.test.alias.Tier" }
+}
+`
+
+func TestEnumNameExtension(t *testing.T) {
+	// The options of the enum values can only be parsed once the extension
+	// is known, so the extension lives in a file of its own.
+	files, types := new(protoregistry.Files), new(protoregistry.Types)
+	extFile := registerTestFile(testAliasExtProtoFile, files, types)
+	xt := dynamicpb.NewExtensionType(extFile.Extensions().ByName("json_alias"))
+	require.NoError(t, types.RegisterExtension(xt))
+
+	fdp := new(descriptorpb.FileDescriptorProto)
+	require.NoError(t, prototext.UnmarshalOptions{Resolver: types}.Unmarshal([]byte(testAliasProtoFile), fdp))
+	fd, err := protodesc.NewFile(fdp, files)
+	require.NoError(t, err)
+	account := dynamicpb.NewMessageType(fd.Messages().ByName("Account"))
+
+	m := newMessage(t, account, `{"tier":"TIER_GOLD","tiers":["TIER_SILVER","TIER_GOLD"]}`)
+	actual, err := MarshalOptions{EnumNameExtension: xt}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"tier":"gold","tiers":["TIER_SILVER","gold"]}`, string(actual))
+
+	actual, err = Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"tier":"TIER_GOLD","tiers":["TIER_SILVER","TIER_GOLD"]}`, string(actual))
+
+	rank := dynamicpb.NewExtensionType(extFile.Extensions().ByName("json_rank"))
+	_, err = MarshalOptions{EnumNameExtension: rank}.Marshal(m)
+	require.Error(t, err)
+}
+
+func TestStable(t *testing.T) {
+	src := `{"id":"x","counts":{"b":2,"a":1,"c":3},"labels":{"10":"a","9":"b","-1":"c"},"attrs":{"k":{"b":true,"a":[1,{"d":null,"c":"s"}]},"j":1},"nested":{"name":"n","count":"1","child":{"name":"c"}},"flag":true}`
+	opts := MarshalOptions{Stable: true}
+
+	var sums [][sha256.Size]byte
+	for i := 0; i < 2; i++ {
+		actual, err := opts.Marshal(newMessage(t, sampleType, src))
+		require.NoError(t, err)
+		require.Equal(t, `{"attrs":{"j":1,"k":{"a":[1,{"c":"s","d":null}],"b":true}},"counts":{"a":1,"b":2,"c":3},"flag":true,"id":"x","labels":{"-1":"c","9":"b","10":"a"},"nested":{"child":{"name":"c"},"count":1,"name":"n"}}`, string(actual))
+		sums = append(sums, sha256.Sum256(actual))
+	}
+	require.Equal(t, sums[0], sums[1])
+
+	actual, err := MarshalOptions{Stable: true, UseProtoNames: true}.Marshal(newMessage(t, sampleType, `{"managerId":"1","id":"x","big":"2"}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"big":2,"id":"x","manager_id":1}`, string(actual))
+}
+
+func TestRedactFunc(t *testing.T) {
+	cardNumber := regexp.MustCompile(`^\d{4}( ?\d{4}){3}$`)
+	var paths []string
+	opts := MarshalOptions{RedactFunc: func(path string, v protoreflect.Value) (bool, string) {
+		paths = append(paths, path)
+		s, ok := v.Interface().(string)
+		if ok && cardNumber.MatchString(s) {
+			return true, "[REDACTED]"
+		}
+		return false, ""
+	}}
+	m := newMessage(t, sampleType, `{
+		"id": "4111 1111 1111 1111",
+		"tags": ["ok", "4111111111111111"],
+		"nested": {"name": "5500 0000 0000 0004", "count": "2"},
+		"children": [{"name": "x"}],
+		"counts": {"a": 1},
+		"alias": "4111111111111111",
+		"attrs": {"card": "4111 1111 1111 1111", "list": ["a"]}
+	}`)
+
+	actual, err := opts.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"[REDACTED]","tags":["ok","[REDACTED]"],"counts":{"a":1},"nested":{"name":"[REDACTED]","count":2},"children":[{"name":"x"}],"alias":"[REDACTED]","attrs":{"card":"[REDACTED]","list":["a"]}}`, string(actual))
+	require.Equal(t, []string{"id", "tags[0]", "tags[1]", "counts[a]", "nested.name", "nested.count", "children[0].name", "alias", "attrs[card]", "attrs[list][0]"}, paths)
+}
+
+func TestInvalidStructValues(t *testing.T) {
+	attrs := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"name": structpb.NewStringValue("x"),
+		"list": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{
+			structpb.NewNumberValue(1),
+			{},
+			structpb.NewNumberValue(math.NaN()),
+		}}),
+	}}
+	m := sampleType.New()
+	m.Set(sampleType.Descriptor().Fields().ByName("attrs"), protoreflect.ValueOfMessage(attrs.ProtoReflect()))
+
+	_, err := Marshal(m.Interface())
+	var pathErr *FieldPathError
+	require.ErrorAs(t, err, &pathErr)
+	require.Equal(t, "attrs[list][1]", pathErr.Path)
+	require.EqualError(t, err, "proto: attrs[list][1]: google.protobuf.Value: none of the oneof fields is set")
+
+	_, err = Marshal(attrs)
+	require.ErrorAs(t, err, &pathErr)
+	require.Equal(t, "[list][1]", pathErr.Path)
+
+	attrs.Fields["list"].GetListValue().Values[1] = structpb.NewNullValue()
+	_, err = Marshal(m.Interface())
+	require.EqualError(t, err, "proto: attrs[list][2]: google.protobuf.Value.number_value: invalid NaN value")
+
+	attrs.Fields["list"].GetListValue().Values[1] = &structpb.Value{}
+	actual, err := MarshalOptions{InvalidValuesAsNull: true}.Marshal(m.Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"attrs":{"list":[1,null,null],"name":"x"}}`, string(actual))
+
+	_, err = MarshalOptions{MaxFields: 1}.Marshal(newMessage(t, sampleType, `{"children":[{},{"child":{"name":"a","count":"1"}}]}`))
+	require.ErrorAs(t, err, &pathErr)
+	require.Equal(t, "children[1].child", pathErr.Path)
+}
+
+func TestDiscriminatorKey(t *testing.T) {
+	m := newMessage(t, sampleType, `{"number":"5","extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"a"},"nickname":"n"}`)
+
+	actual, err := Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"number":5,"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"a"},"nickname":"n"}`, string(actual))
+
+	actual, err = MarshalOptions{DiscriminatorKey: "type"}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"number":5,"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","type":"jsonpb.test.Nested","name":"a"},"nickname":"n","choiceType":"number"}`, string(actual))
+
+	m = newMessage(t, sampleType, `{"text":"x","extra":{"@type":"type.googleapis.com/google.protobuf.Duration","value":"1s"}}`)
+	actual, err = MarshalOptions{DiscriminatorKey: "type", UseProtoNames: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"text":"x","extra":{"@type":"type.googleapis.com/google.protobuf.Duration","type":"google.protobuf.Duration","value":"1s"},"choice_type":"text"}`, string(actual))
+
+	actual, err = MarshalOptions{DiscriminatorKey: "type"}.Marshal(newMessage(t, sampleType, `{"id":"a"}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a"}`, string(actual))
+
+	// Discriminators count towards MaxFields.
+	m = newMessage(t, sampleType, `{"number":"5","extra":{"@type":"type.googleapis.com/jsonpb.test.Nested"}}`)
+	_, err = MarshalOptions{DiscriminatorKey: "type", MaxFields: 2}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Sample: more than 2 fields")
+	m = newMessage(t, sampleType, `{"number":"5","extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"a"}}`)
+	_, err = MarshalOptions{DiscriminatorKey: "type", MaxFields: 2}.Marshal(m)
+	require.ErrorContains(t, err, "jsonpb.test.Nested: more than 2 fields")
+	_, err = MarshalOptions{DiscriminatorKey: "type", MaxFields: 1}.Marshal(newMessage(t, sampleType, `{"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"a"}}`))
+	require.ErrorContains(t, err, "jsonpb.test.Nested: more than 1 fields")
+	_, err = MarshalOptions{DiscriminatorKey: "type", MaxFields: 3}.Marshal(m)
+	require.NoError(t, err)
+}
+
+const testShapeProtoFile = `
+name: "jsonpb/shape.proto"
+package: "jsonpb.test.shape"
+syntax: "proto3"
+message_type {
+  name: "Shape"
+  field { name: "circle" number: 1 label: LABEL_OPTIONAL type: TYPE_DOUBLE oneof_index: 0 }
+  field { name: "square" number: 2 label: LABEL_OPTIONAL type: TYPE_DOUBLE oneof_index: 0 }
+  field { name: "shape_type" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  oneof_decl { name: "shape" }
+}
+`
+
+func TestDiscriminatorKeyCollision(t *testing.T) {
+	fd := registerTestFile(testShapeProtoFile, new(protoregistry.Files), new(protoregistry.Types))
+	shape := newMessage(t, dynamicpb.NewMessageType(fd.Messages().ByName("Shape")), `{"circle":1.5,"shapeType":"x"}`)
+
+	for _, opts := range []MarshalOptions{{DiscriminatorKey: "type"}, {DiscriminatorKey: "type", UseProtoNames: true}} {
+		_, err := opts.Marshal(shape)
+		require.ErrorContains(t, err, "collides with field shape_type")
+	}
+	actual, err := MarshalOptions{DiscriminatorKey: "kind"}.Marshal(shape)
+	require.NoError(t, err)
+	require.Equal(t, `{"circle":1.5,"shapeType":"x","shapeKind":"circle"}`, string(actual))
+
+	embedded := newMessage(t, sampleType, `{"extra":{"@type":"type.googleapis.com/jsonpb.test.Nested","name":"a"}}`)
+	for _, key := range []string{"name", "@type"} {
+		_, err = MarshalOptions{DiscriminatorKey: key}.Marshal(embedded)
+		require.ErrorContains(t, err, "collides", key)
+	}
+	wkt := newMessage(t, sampleType, `{"extra":{"@type":"type.googleapis.com/google.protobuf.Duration","value":"1s"}}`)
+	for _, key := range []string{"value", "@type"} {
+		_, err = MarshalOptions{DiscriminatorKey: key}.Marshal(wkt)
+		require.ErrorContains(t, err, "collides", key)
+	}
+}
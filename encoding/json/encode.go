@@ -5,6 +5,8 @@
 package json
 
 import (
+	"bytes"
+	stdjson "encoding/json"
 	"math"
 	"math/bits"
 	"strconv"
@@ -34,6 +36,9 @@ type Encoder struct {
 	lastKind kind
 	indents  []byte
 	out      []byte
+
+	// allowLineSeparators disables escaping U+2028 and U+2029 in strings.
+	allowLineSeparators bool
 }
 
 // NewEncoder returns an Encoder.
@@ -53,6 +58,14 @@ func NewEncoder(buf []byte, indent string) (*Encoder, error) {
 	return e, nil
 }
 
+// SetAllowLineSeparators specifies whether the line and paragraph separators
+// U+2028 and U+2029 are written as is in strings. By default they are escaped
+// as \u2028 and \u2029, like encoding/json does, since JavaScript does not
+// allow them in string literals.
+func (e *Encoder) SetAllowLineSeparators(allow bool) {
+	e.allowLineSeparators = allow
+}
+
 // Bytes returns the content of the written bytes.
 func (e *Encoder) Bytes() []byte {
 	return e.out
@@ -79,7 +92,7 @@ func (e *Encoder) WriteBool(b bool) {
 func (e *Encoder) WriteString(s string) error {
 	e.prepareNext(scalar)
 	var err error
-	if e.out, err = appendString(e.out, s); err != nil {
+	if e.out, err = appendString(e.out, s, !e.allowLineSeparators); err != nil {
 		return err
 	}
 	return nil
@@ -88,9 +101,9 @@ func (e *Encoder) WriteString(s string) error {
 // Sentinel error used for indicating invalid UTF-8.
 var errInvalidUTF8 = errors.New("invalid UTF-8")
 
-func appendString(out []byte, in string) ([]byte, error) {
+func appendString(out []byte, in string, escapeLineSeparators bool) ([]byte, error) {
 	out = append(out, '"')
-	i := indexNeedEscapeInString(in)
+	i := indexNeedEscapeInString(in, escapeLineSeparators)
 	in, out = in[i:], append(out, in[:i]...)
 	for len(in) > 0 {
 		switch r, n := utf8.DecodeRuneInString(in); {
@@ -117,8 +130,12 @@ func appendString(out []byte, in string) ([]byte, error) {
 				out = strconv.AppendUint(out, uint64(r), 16)
 			}
 			in = in[n:]
+		case escapeLineSeparators && (r == '\u2028' || r == '\u2029'):
+			out = append(out, `\u202`...)
+			out = append(out, "89"[r&1])
+			in = in[n:]
 		default:
-			i := indexNeedEscapeInString(in[n:])
+			i := indexNeedEscapeInString(in[n:], escapeLineSeparators)
 			in, out = in[n+i:], append(out, in[:n+i]...)
 		}
 	}
@@ -128,9 +145,10 @@ func appendString(out []byte, in string) ([]byte, error) {
 
 // indexNeedEscapeInString returns the index of the character that needs
 // escaping. If no characters need escaping, this returns the input length.
-func indexNeedEscapeInString(s string) int {
+func indexNeedEscapeInString(s string, escapeLineSeparators bool) int {
 	for i, r := range s {
-		if r < ' ' || r == '\\' || r == '"' || r == utf8.RuneError {
+		if r < ' ' || r == '\\' || r == '"' || r == utf8.RuneError ||
+			escapeLineSeparators && (r == '\u2028' || r == '\u2029') {
 			return i
 		}
 	}
@@ -143,6 +161,22 @@ func (e *Encoder) WriteFloat(n float64, bitSize int) {
 	e.out = appendFloat(e.out, n, bitSize)
 }
 
+// WriteFloatDecimal is like WriteFloat, except that integral values written in
+// plain decimal notation are given a ".0" fraction so that they still read as
+// floating point numbers.
+func (e *Encoder) WriteFloatDecimal(n float64, bitSize int) {
+	e.prepareNext(scalar)
+	start := len(e.out)
+	e.out = appendFloat(e.out, n, bitSize)
+	for _, c := range e.out[start:] {
+		switch c {
+		case '.', 'e', '"':
+			return
+		}
+	}
+	e.out = append(e.out, '.', '0')
+}
+
 // appendFloat formats given float in bitSize, and appends to the given []byte.
 func appendFloat(out []byte, n float64, bitSize int) []byte {
 	switch {
@@ -186,6 +220,25 @@ func (e *Encoder) WriteUint(n uint64) {
 	e.out = strconv.AppendUint(e.out, n, 10)
 }
 
+// WriteRawValue writes out the given JSON encoded value, such as the output of
+// the standard library encoding/json. The value is compacted or re-indented to
+// fit the current nesting level. Returns error if b is not valid JSON.
+func (e *Encoder) WriteRawValue(b []byte) error {
+	var buf bytes.Buffer
+	var err error
+	if len(e.indent) == 0 {
+		err = stdjson.Compact(&buf, b)
+	} else {
+		err = stdjson.Indent(&buf, b, string(e.indents), e.indent)
+	}
+	if err != nil {
+		return err
+	}
+	e.prepareNext(scalar)
+	e.out = append(e.out, buf.Bytes()...)
+	return nil
+}
+
 // StartObject writes out the '{' symbol.
 func (e *Encoder) StartObject() {
 	e.prepareNext(objectOpen)
@@ -205,7 +258,7 @@ func (e *Encoder) WriteName(s string) error {
 	e.prepareNext(name)
 	var err error
 	// Append to output regardless of error.
-	e.out, err = appendString(e.out, s)
+	e.out, err = appendString(e.out, s, !e.allowLineSeparators)
 	e.out = append(e.out, ':')
 	return err
 }
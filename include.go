@@ -0,0 +1,76 @@
+package jsonpb
+
+import (
+	"strings"
+
+	"jsonpb/errors"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// MarshalInclude writes the fields of m listed in paths in JSON format using
+// default options. See MarshalOptions.MarshalInclude.
+func MarshalInclude(m proto.Message, paths []string) ([]byte, error) {
+	return MarshalOptions{}.MarshalInclude(m, paths)
+}
+
+// MarshalInclude is like Marshal, except that only the fields named by paths
+// are written out. Each path is a dot-separated list of lowerCamelCase JSON
+// field names, such as "nested.name", resolved against the descriptor of m.
+// Selecting a message field includes it in full, selecting a field within it
+// includes only that field. Paths may not descend into maps or well-known
+// types.
+func (o MarshalOptions) MarshalInclude(m proto.Message, paths []string) ([]byte, error) {
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return o.marshal(nil, nil, nil, nil)
+	}
+	tree, err := newIncludeTree(m.ProtoReflect().Descriptor(), paths)
+	if err != nil {
+		return nil, err
+	}
+	return o.marshal(nil, m, tree, nil)
+}
+
+// includeTree is the set of fields of a message selected by MarshalInclude.
+// A field mapping to a nil tree is included in full.
+type includeTree map[protoreflect.FieldNumber]includeTree
+
+// newIncludeTree resolves the JSON paths against the message descriptor md.
+func newIncludeTree(md protoreflect.MessageDescriptor, paths []string) (includeTree, error) {
+	if isWellKnown(md.FullName()) {
+		return nil, errors.New("cannot select fields of %v", md.FullName())
+	}
+	root := includeTree{}
+	for _, path := range paths {
+		node, d := root, md
+		names := strings.Split(path, ".")
+		for i, name := range names {
+			fd := d.Fields().ByJSONName(name)
+			if fd == nil {
+				return nil, errors.New("invalid include path %q: %v has no field %q", path, d.FullName(), name)
+			}
+			if i == len(names)-1 {
+				node[fd.Number()] = nil
+				break
+			}
+			if fd.Message() == nil || fd.IsMap() || isWellKnown(fd.Message().FullName()) {
+				return nil, errors.New("invalid include path %q: cannot select fields of %v", path, fd.FullName())
+			}
+			child, ok := node[fd.Number()]
+			if ok && child == nil {
+				break // already included in full
+			}
+			if !ok {
+				child = includeTree{}
+				node[fd.Number()] = child
+			}
+			node, d = child, fd.Message()
+		}
+	}
+	return root, nil
+}
@@ -0,0 +1,44 @@
+package jsonpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalInclude(t *testing.T) {
+	m := newMessage(t, sampleType, `{
+		"id": "a",
+		"managerId": "7",
+		"tags": ["x"],
+		"nested": {"name": "n", "count": "2", "child": {"name": "c", "count": "3"}},
+		"children": [{"name": "c1", "count": "1"}, {"name": "c2"}],
+		"createdAt": "2023-08-29T00:00:00Z"
+	}`)
+
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{nil, `{}`},
+		{[]string{"id", "createdAt"}, `{"id":"a","createdAt":"2023-08-29T00:00:00Z"}`},
+		{[]string{"nested"}, `{"nested":{"name":"n","count":2,"child":{"name":"c","count":3}}}`},
+		{[]string{"nested.count", "managerId"}, `{"managerId":7,"nested":{"count":2}}`},
+		{[]string{"nested.child.name"}, `{"nested":{"child":{"name":"c"}}}`},
+		{[]string{"nested.child.name", "nested"}, `{"nested":{"name":"n","count":2,"child":{"name":"c","count":3}}}`},
+		{[]string{"children.name"}, `{"children":[{"name":"c1"},{"name":"c2"}]}`},
+	}
+	for _, tt := range tests {
+		actual, err := MarshalInclude(m, tt.paths)
+		require.NoError(t, err, tt.paths)
+		require.Equal(t, tt.want, string(actual), tt.paths)
+	}
+}
+
+func TestMarshalIncludeInvalidPath(t *testing.T) {
+	m := newMessage(t, sampleType, `{"id":"a"}`)
+	for _, path := range []string{"missing", "manager_id", "nested.missing", "id.length", "createdAt.seconds", "counts.key"} {
+		_, err := MarshalInclude(m, []string{path})
+		require.Error(t, err, path)
+	}
+}
@@ -0,0 +1,188 @@
+package jsonpb
+
+import (
+	stdjson "encoding/json"
+
+	"jsonpb/errors"
+	"jsonpb/genid"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// EmittedKeys returns the keys of the JSON object that Marshal writes for m
+// using default options. See MarshalOptions.EmittedKeys.
+func EmittedKeys(m proto.Message) ([]string, error) {
+	return MarshalOptions{}.EmittedKeys(m)
+}
+
+// EmittedKeys returns the keys of the top-level JSON object that Marshal
+// writes for m with the options o, in the order they are written, such as for
+// checking the shape of a response in tests. The keys follow every option,
+// like EmitUnpopulated or UseProtoNames, and include members such as "@type".
+// It returns no keys for messages not written as a JSON object, as is the
+// case for some well-known types.
+//
+// EmittedKeys walks the top level of m like Marshal does, without writing any
+// output. The values of the members are not looked at, so that errors Marshal
+// would report for them, such as for invalid UTF-8, are not.
+func (o MarshalOptions) EmittedKeys(m proto.Message) ([]string, error) {
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	object := true
+	if m != nil {
+		e := encoder{opts: o, presence: o.EmitPresenceMask, snakeCase: o.TopLevelSnakeCase}
+		if fd := e.pageField(m.ProtoReflect().Descriptor()); fd != nil {
+			keys, err = e.pageMemberNames(m.ProtoReflect(), fd)
+		} else {
+			keys, object, err = e.messageMemberNames(m.ProtoReflect(), "")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !o.AllowPartial {
+			if err := proto.CheckInitialized(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if o.RootKey != "" {
+		return []string{o.RootKey}, nil
+	}
+	if object && len(keys) == 0 && o.EmptyTemplate != "" {
+		if _, err := rangeMembers([]byte(o.EmptyTemplate), func(name string, _ stdjson.RawMessage) {
+			keys = append(keys, name)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// pageMemberNames returns the names of the members that marshalPage writes.
+func (e encoder) pageMemberNames(m protoreflect.Message, fd protoreflect.FieldDescriptor) ([]string, error) {
+	items, count := e.opts.pageKeys()
+	keys := []string{items, count}
+	if e.tooManyFields(len(keys)) {
+		return nil, e.maxFieldsError(m.Descriptor())
+	}
+	if _, err := e.rangePageFields(m, fd, len(keys), func(_ encoder, _ protoreflect.FieldDescriptor, _ protoreflect.Value, name string) error {
+		keys = append(keys, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if e.presence {
+		if keys = append(keys, presenceMaskName); e.tooManyFields(len(keys)) {
+			return nil, e.maxFieldsError(m.Descriptor())
+		}
+	}
+	return keys, nil
+}
+
+// messageMemberNames returns the names of the members that marshalMessage
+// writes, and whether it writes a JSON object at all.
+func (e encoder) messageMemberNames(m protoreflect.Message, typeURL string) ([]string, bool, error) {
+	md := m.Descriptor()
+	if isWellKnown(md.FullName()) {
+		return e.wellKnownMemberNames(m)
+	}
+
+	var keys []string
+	if typeURL != "" {
+		keys = append(keys, "@type")
+		key, err := e.anyDiscriminator(md)
+		if err != nil {
+			return nil, false, err
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+		if e.tooManyFields(len(keys)) {
+			return nil, false, e.maxFieldsError(md)
+		}
+	}
+	if _, err := e.rangeFields(m, nil, len(keys), func(_ encoder, _ protoreflect.FieldDescriptor, _ protoreflect.Value, name string) error {
+		keys = append(keys, name)
+		return nil
+	}); err != nil {
+		return nil, false, err
+	}
+	if _, err := e.rangeOneofDiscriminators(m, len(keys), func(name string, _ protoreflect.FieldDescriptor) error {
+		keys = append(keys, name)
+		return nil
+	}); err != nil {
+		return nil, false, err
+	}
+	if e.presence {
+		if keys = append(keys, presenceMaskName); e.tooManyFields(len(keys)) {
+			return nil, false, e.maxFieldsError(md)
+		}
+	}
+	return keys, true, nil
+}
+
+// wellKnownMemberNames is messageMemberNames for the well-known types, of
+// which google.protobuf.Any, Struct and Empty, and Value holding a Struct, are
+// written as JSON objects.
+func (e encoder) wellKnownMemberNames(m protoreflect.Message) ([]string, bool, error) {
+	fds := m.Descriptor().Fields()
+	switch m.Descriptor().FullName() {
+	case genid.Any_message_fullname:
+		if !m.Has(fds.ByNumber(genid.Any_TypeUrl_field_number)) {
+			switch {
+			case !m.Has(fds.ByNumber(genid.Any_Value_field_number)):
+				return nil, true, nil
+			case e.opts.UntypedAnyKey != "":
+				return []string{e.opts.UntypedAnyKey}, true, nil
+			}
+			return nil, false, errors.New("%s: %v is not set", genid.Any_message_fullname, genid.Any_TypeUrl_field_name)
+		}
+		typeURL, em, err := e.unpackAny(m)
+		if err != nil {
+			return nil, false, err
+		}
+		if !isWellKnown(em.Descriptor().FullName()) {
+			return e.messageMemberNames(em, typeURL)
+		}
+		keys := []string{"@type"}
+		key, err := e.anyDiscriminator(em.Descriptor())
+		if err != nil {
+			return nil, false, err
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+		if keys = append(keys, "value"); e.tooManyFields(len(keys)) {
+			return nil, false, e.maxFieldsError(m.Descriptor())
+		}
+		return keys, true, nil
+
+	case genid.Struct_message_fullname:
+		fd := fds.ByNumber(genid.Struct_Fields_field_number)
+		var keys []string
+		if err := e.rangeMapEntries(m.Get(fd).Map(), fd, func(_ encoder, _ protoreflect.MapKey, _ protoreflect.Value, name string) error {
+			keys = append(keys, name)
+			return nil
+		}); err != nil {
+			return nil, false, err
+		}
+		return keys, true, nil
+
+	case genid.Value_message_fullname:
+		fd := m.WhichOneof(m.Descriptor().Oneofs().ByName(genid.Value_Kind_oneof_name))
+		if fd != nil && fd.Number() == genid.Value_StructValue_field_number {
+			return e.wellKnownMemberNames(m.Get(fd).Message())
+		}
+		return nil, false, nil
+
+	case genid.Empty_message_fullname:
+		return nil, true, nil
+	}
+	return nil, false, nil
+}
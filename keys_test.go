@@ -0,0 +1,113 @@
+package jsonpb
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// marshaledKeys returns the keys of the JSON object b in order.
+func marshaledKeys(t *testing.T, b []byte) []string {
+	t.Helper()
+	d := stdjson.NewDecoder(bytes.NewReader(b))
+	tok, err := d.Token()
+	require.NoError(t, err)
+	require.Equal(t, stdjson.Delim('{'), tok)
+	var keys []string
+	for d.More() {
+		tok, err := d.Token()
+		require.NoError(t, err)
+		keys = append(keys, tok.(string))
+		var v stdjson.RawMessage
+		require.NoError(t, d.Decode(&v))
+	}
+	return keys
+}
+
+func TestEmittedKeys(t *testing.T) {
+	m := newMessage(t, sampleType, `{"id":"a","managerId":"1","nested":{"name":"n"},"text":"t","labels":{"1":"x"}}`)
+
+	keys, err := EmittedKeys(m)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id", "managerId", "nested", "text", "labels"}, keys)
+
+	for _, opts := range []MarshalOptions{
+		{UseProtoNames: true, Multiline: true},
+		{EmitUnpopulated: true},
+		{EmitPresenceMask: true, TopLevelSnakeCase: true},
+		{DiscriminatorKey: "type", RootKey: "sample"},
+		{Stable: true},
+	} {
+		actual, err := opts.Marshal(m)
+		require.NoError(t, err)
+		keys, err := opts.EmittedKeys(m)
+		require.NoError(t, err)
+		require.Equal(t, marshaledKeys(t, actual), keys, "%+v", opts)
+	}
+
+	a, err := anypb.New(durationpb.New(1))
+	require.NoError(t, err)
+	keys, err = EmittedKeys(a)
+	require.NoError(t, err)
+	require.Equal(t, []string{"@type", "value"}, keys)
+
+	keys, err = EmittedKeys(durationpb.New(1))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	_, err = MarshalOptions{MaxFields: 1}.EmittedKeys(m)
+	require.Error(t, err)
+}
+
+func TestEmittedKeysMatchMarshal(t *testing.T) {
+	st, err := structpb.NewStruct(map[string]interface{}{"b": 1, "a": "x"})
+	require.NoError(t, err)
+	extra := newMessage(t, sampleType, `{"number":"1","extra":{"@type":"type.googleapis.com/jsonpb.test.Sample","text":"t","id":"a"}}`)
+	embedded := extra.ProtoReflect().Get(sampleType.Descriptor().Fields().ByName("extra")).Message().Interface()
+	page := newMessage(t, newListNestedResponseType(t), `{"nested":[{"name":"a"}],"nextPageToken":"t"}`)
+	pageTypes := []protoreflect.FullName{page.ProtoReflect().Descriptor().FullName()}
+	tests := []struct {
+		opts MarshalOptions
+		m    proto.Message
+	}{
+		{MarshalOptions{}, st},
+		{MarshalOptions{}, structpb.NewStructValue(st)},
+		{MarshalOptions{}, &emptypb.Empty{}},
+		{MarshalOptions{EmptyTemplate: `{"data":{},"meta":{}}`}, &emptypb.Empty{}},
+		{MarshalOptions{EmptyTemplate: `{"data":{}}`}, sampleType.New().Interface()},
+		{MarshalOptions{DiscriminatorKey: "kind", EmitPresenceMask: true}, embedded},
+		{MarshalOptions{DiscriminatorKey: "kind", UseProtoNames: true}, extra},
+		{MarshalOptions{UntypedAnyKey: "raw"}, &anypb.Any{Value: []byte{0x0a, 0x01, 'a'}}},
+		{MarshalOptions{Paginate: true, PageTypes: pageTypes, EmitPresenceMask: true, EmitUnpopulated: true}, page},
+		{MarshalOptions{Paginate: true, PageTypes: pageTypes, PageItemsKey: "results"}, page},
+	}
+	for _, tt := range tests {
+		actual, err := tt.opts.Marshal(tt.m)
+		require.NoError(t, err)
+		keys, err := tt.opts.EmittedKeys(tt.m)
+		require.NoError(t, err)
+		require.Equal(t, marshaledKeys(t, actual), keys, "%s", actual)
+	}
+
+	_, err = EmittedKeys(&anypb.Any{Value: []byte{1}})
+	require.Error(t, err)
+	_, err = MarshalOptions{MaxFields: 1}.EmittedKeys(st)
+	require.Error(t, err)
+
+	// Values are not looked at.
+	invalid := newMessage(t, sampleType, `{"id":"a"}`)
+	invalid.ProtoReflect().Set(sampleType.Descriptor().Fields().ByName("id"), protoreflect.ValueOfString("\xff"))
+	_, err = Marshal(invalid)
+	require.Error(t, err)
+	keys, err := EmittedKeys(invalid)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id"}, keys)
+}
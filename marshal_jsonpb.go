@@ -1,9 +1,12 @@
 package jsonpb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"io"
+	"reflect"
+	"sync"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -11,65 +14,185 @@ import (
 )
 
 // JSONPb is a Marshaler which marshals/unmarshals into/from JSON
-// with the "google.golang.org/protobuf/encoding/protojson" marshaler.
+// with the MarshalOptions of this package and protojson.UnmarshalOptions,
+// extended by the Decoding options of this package.
 // It supports the full functionality of protobuf unlike JSONBuiltin.
 //
 // The NewDecoder method returns a DecoderWrapper, so the underlying
 // *json.Decoder methods can be used.
+//
+// Types held by google.protobuf.Any are looked up with the Resolver of
+// MarshalOptions and of protojson.UnmarshalOptions. For types outside
+// protoregistry.GlobalTypes, set both to the same registry so that the output
+// reads back.
 type JSONPb struct {
 	MarshalOptions
 	protojson.UnmarshalOptions
+
+	// Decoding enables the decoding options of this package that go beyond
+	// protojson.UnmarshalOptions, such as SparseRepeated.
+	Decoding DecodingOptions
+
+	// NDJSON selects the streaming mode for newline-delimited JSON: the
+	// encoder returned by NewEncoder writes every value on a single line,
+	// whatever the indentation options, and ContentType reports
+	// NDJSONContentType.
+	NDJSON bool
+
+	// NDJSONContentType is the content type reported in the NDJSON mode.
+	// If empty, it defaults to "application/x-ndjson".
+	NDJSONContentType string
 }
 
-// ContentType always returns "application/json".
-func (*JSONPb) ContentType(_ interface{}) string {
+// ContentType returns "application/json", or the NDJSONContentType in the
+// NDJSON mode.
+func (j *JSONPb) ContentType(_ interface{}) string {
+	if j.NDJSON {
+		if j.NDJSONContentType != "" {
+			return j.NDJSONContentType
+		}
+		return "application/x-ndjson"
+	}
 	return "application/json"
 }
 
 // Marshal marshals "v" into JSON.
 func (j *JSONPb) Marshal(v interface{}) ([]byte, error) {
-	if _, ok := v.(proto.Message); !ok {
-		return json.Marshal(v)
-	}
-
-	var buf bytes.Buffer
-	if err := j.marshalTo(&buf, v); err != nil {
+	bp := getBuffer()
+	defer putBuffer(bp)
+	b, err := j.marshalAppend((*bp)[:0], v)
+	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	*bp = b
+	// Copy the result out, as the pooled buffer is reused once it is returned.
+	return append([]byte(nil), b...), nil
+}
+
+// MarshalTo marshals "v" into JSON and writes the result to every writer in
+// "ws", such as a response and an audit log. "v" is encoded once and the same
+// bytes are written to each writer in turn, so the first failing write aborts
+// the remaining ones.
+func (j *JSONPb) MarshalTo(v interface{}, ws ...io.Writer) error {
+	return j.marshalTo(io.MultiWriter(ws...), v)
 }
 
 func (j *JSONPb) marshalTo(w io.Writer, v interface{}) error {
-	p, ok := v.(proto.Message)
-	if !ok {
-		buf, err := json.Marshal(v)
-		if err != nil {
-			return err
-		}
-		_, err = w.Write(buf)
-		return err
-	}
-	b, err := j.MarshalOptions.Marshal(p)
+	bp := getBuffer()
+	defer putBuffer(bp)
+	b, err := j.marshalAppend((*bp)[:0], v)
 	if err != nil {
 		return err
 	}
-
+	*bp = b
 	_, err = w.Write(b)
 	return err
 }
 
+// marshalAppend appends the JSON encoding of "v" to "b".
+func (j *JSONPb) marshalAppend(b []byte, v interface{}) ([]byte, error) {
+	o, err := j.MarshalOptions.prepare()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := v.(proto.Message); ok {
+		return o.marshal(b, p, nil, nil)
+	}
+	return o.marshalReflect(b, v)
+}
+
+// maxPooledBuffer is the largest capacity of a buffer kept in bufferPool, so
+// that a single large response does not pin its memory for good.
+const maxPooledBuffer = 64 << 10
+
+// bufferPool holds the scratch buffers that JSONPb encodes into.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
+}
+
 // Unmarshal unmarshals JSON "data" into "v"
 func (j *JSONPb) Unmarshal(data []byte, v interface{}) error {
-	return unmarshalJSONPb(data, j.UnmarshalOptions, v)
+	return unmarshalJSONPb(data, j.Decoding.withProtoJSON(j.UnmarshalOptions), v)
 }
 
-// NewDecoder returns a Decoder which reads JSON stream from "r".
+// NewDecoder returns a Decoder which reads JSON stream from "r". With
+// RelaxedJSON, the stream is rewritten into standard JSON on the way, so that
+// the underlying *json.Decoder reads the rewritten input.
 func (j *JSONPb) NewDecoder(r io.Reader) runtime.Decoder {
-	d := json.NewDecoder(r)
+	d := j.Decoding.newJSONDecoder(r)
 	return DecoderWrapper{
 		Decoder:          d,
 		UnmarshalOptions: j.UnmarshalOptions,
+		Decoding:         j.Decoding,
+	}
+}
+
+// NewSequenceDecoder returns a Decoder which reads a JSON text sequence
+// (RFC 7464) from "r": values each preceded by a record separator (0x1E), such
+// as in some log formats. Repeated or missing separators are tolerated. Every
+// separator ends a record, so that a value holding a raw 0x1E, which is not
+// valid JSON, is an error.
+func (j *JSONPb) NewSequenceDecoder(r io.Reader) runtime.Decoder {
+	return &sequenceDecoder{
+		r:        bufio.NewReader(r),
+		opts:     j.UnmarshalOptions,
+		decoding: j.Decoding,
+	}
+}
+
+// recordSeparator starts every record of a JSON text sequence.
+const recordSeparator = 0x1E
+
+// sequenceDecoder reads a JSON text sequence record by record, decoding the
+// values of each record with a DecoderWrapper.
+type sequenceDecoder struct {
+	r        *bufio.Reader
+	opts     protojson.UnmarshalOptions
+	decoding DecodingOptions
+
+	// record decodes the current record, once one is read.
+	record *DecoderWrapper
+}
+
+// Decode reads the next value of the sequence into "v". It returns io.EOF at
+// the end of the input.
+func (d *sequenceDecoder) Decode(v interface{}) error {
+	for d.record == nil || !d.record.More() {
+		b, err := d.r.ReadBytes(recordSeparator)
+		if err != nil && (err != io.EOF || len(b) == 0) {
+			return err
+		}
+		d.record = &DecoderWrapper{
+			Decoder:          d.decoding.newJSONDecoder(bytes.NewReader(bytes.TrimSuffix(b, []byte{recordSeparator}))),
+			UnmarshalOptions: d.opts,
+			Decoding:         d.decoding,
+		}
 	}
+	return d.record.Decode(v)
+}
+
+// newJSONDecoder returns a *json.Decoder reading from r, which is rewritten
+// from relaxed JSON with RelaxedJSON.
+func (d DecodingOptions) newJSONDecoder(r io.Reader) *json.Decoder {
+	if d.RelaxedJSON {
+		r = newRelaxedReader(r)
+	}
+	return json.NewDecoder(r)
 }
 
 // DecoderWrapper is a wrapper around a *json.Decoder that adds
@@ -77,10 +200,39 @@ func (j *JSONPb) NewDecoder(r io.Reader) runtime.Decoder {
 type DecoderWrapper struct {
 	*json.Decoder
 	protojson.UnmarshalOptions
+
+	// Decoding holds the decoding options beyond protojson.UnmarshalOptions,
+	// as in JSONPb.
+	Decoding DecodingOptions
+}
+
+// Decode reads the next JSON-encoded value from its input and stores it in
+// "v". Protos, and Go values holding protos, are read with the
+// UnmarshalOptions and the Decoding options; anything else is decoded by the
+// underlying *json.Decoder.
+// It returns io.EOF at the end of the input.
+func (d DecoderWrapper) Decode(v interface{}) error {
+	if _, ok := v.(proto.Message); !ok && (v == nil || !containsMessage(reflect.TypeOf(v))) {
+		return d.Decoder.Decode(v)
+	}
+	var b json.RawMessage
+	if err := d.Decoder.Decode(&b); err != nil {
+		return err
+	}
+	// The *json.Decoder only reads standard JSON, which needs no rewriting.
+	decoding := d.Decoding
+	decoding.RelaxedJSON = false
+	return unmarshalJSONPb(b, decoding.withProtoJSON(d.UnmarshalOptions), v)
 }
 
 // NewEncoder returns an Encoder which writes JSON stream into "w".
 func (j *JSONPb) NewEncoder(w io.Writer) runtime.Encoder {
+	if j.NDJSON {
+		// Each value must fit on its line.
+		compact := *j
+		compact.Multiline, compact.Indent = false, ""
+		j = &compact
+	}
 	return EncoderFunc(func(v interface{}) error {
 		if err := j.marshalTo(w, v); err != nil {
 			return err
@@ -92,10 +244,17 @@ func (j *JSONPb) NewEncoder(w io.Writer) runtime.Encoder {
 	})
 }
 
-func unmarshalJSONPb(data []byte, unmarshaler protojson.UnmarshalOptions, v interface{}) error {
+func unmarshalJSONPb(data []byte, unmarshaler UnmarshalOptions, v interface{}) error {
+	if unmarshaler.RelaxedJSON {
+		var err error
+		if data, err = relaxJSON(data); err != nil {
+			return err
+		}
+		unmarshaler.RelaxedJSON = false
+	}
 	p, ok := v.(proto.Message)
 	if !ok {
-		return json.Unmarshal(data, v)
+		return unmarshaler.unmarshalReflect(data, v)
 	}
 
 	d := json.NewDecoder(bytes.NewReader(data))
@@ -1,18 +1,33 @@
 package jsonpb
 
 import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type TestStruct struct {
 	Id        string
-	ManagerId int64
 	CreatedAt *timestamppb.Timestamp
+	ManagerId int64
 }
 
 func TestJSONPbMarshal(t *testing.T) {
@@ -33,3 +48,731 @@ func TestJSONPbMarshal(t *testing.T) {
 	expected := []byte(`{"id":"id","createdAt":"2023-08-29T00:00:00Z","managerId":18014398509481984}`)
 	require.Equal(t, expected, actual)
 }
+
+func TestJSONPbMarshalMessageMap(t *testing.T) {
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{CamelCaseMapKeys: true}}
+
+	v := map[string]*dynamicpb.Message{
+		"first_item":  newMessage(t, nestedType, `{"name":"a","count":"1"}`).(*dynamicpb.Message),
+		"second_item": nil,
+	}
+	actual, err := marshaler.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"firstItem":{"name":"a","count":1},"secondItem":null}`, string(actual))
+
+	// Proto map fields follow the same option, google.protobuf.Struct does not.
+	m := newMessage(t, sampleType, `{"counts":{"big_one":"5"},"attrs":{"snake_key":1}}`)
+	actual, err = marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"counts":{"bigOne":5},"attrs":{"snake_key":1}}`, string(actual))
+
+	// Maps without messages are still marshaled by encoding/json.
+	actual, err = marshaler.Marshal(map[string]int{"b_key": 2, "a_key": 1})
+	require.NoError(t, err)
+	require.Equal(t, `{"a_key":1,"b_key":2}`, string(actual))
+}
+
+func TestJSONPbDualMapKeys(t *testing.T) {
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{DualMapKeys: true, CamelCaseMapKeys: true}}
+
+	m := newMessage(t, sampleType, `{"counts":{"big_one":"5","plain":"1","a_b":"2","aB":"3"},"attrs":{"snake_key":1}}`)
+	actual, err := marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"counts":{"aB":3,"a_b":2,"big_one":5,"bigOne":5,"plain":1},"attrs":{"snake_key":1}}`, string(actual))
+
+	v := map[string]*dynamicpb.Message{"first_item": newMessage(t, nestedType, `{"name":"a"}`).(*dynamicpb.Message)}
+	actual, err = marshaler.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"first_item":{"name":"a"},"firstItem":{"name":"a"}}`, string(actual))
+
+	var back map[string]interface{}
+	require.NoError(t, stdjson.Unmarshal(actual, &back))
+	require.Equal(t, back["first_item"], back["firstItem"])
+
+	_, err = (&JSONPb{MarshalOptions: MarshalOptions{DualMapKeys: true, MaxFields: 4}}).Marshal(m)
+	require.ErrorContains(t, err, "more than 4 entries")
+
+	// Keys sharing their lowerCamelCase form get a single alias.
+	m = newMessage(t, sampleType, `{"counts":{"a_b":"1","a__b":"2"}}`)
+	actual, err = marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"counts":{"a__b":2,"aB":2,"a_b":1}}`, string(actual))
+	shared := map[string]*dynamicpb.Message{"a_b": v["first_item"], "a__b": v["first_item"]}
+	actual, err = marshaler.Marshal(shared)
+	require.NoError(t, err)
+	require.Equal(t, `{"a__b":{"name":"a"},"aB":{"name":"a"},"a_b":{"name":"a"}}`, string(actual))
+}
+
+type testInner struct {
+	At    *timestamppb.Timestamp `json:"at"`
+	Count int
+}
+
+type testEnvelope struct {
+	Name   string
+	Inner  *testInner
+	Stamp  *timestamppb.Timestamp
+	Values map[string]*structpb.Value
+	Items  []*durationpb.Duration
+}
+
+func TestJSONPbUnmarshalAllocatesPointers(t *testing.T) {
+	marshaler := &JSONPb{}
+
+	var env testEnvelope
+	err := marshaler.Unmarshal([]byte(`{
+		"name": "x",
+		"inner": {"at": "2023-08-29T00:00:00.5Z", "count": 2},
+		"stamp": "2023-08-29T00:00:00Z",
+		"values": {"v": "s", "n": null},
+		"items": ["1.5s", null]
+	}`), &env)
+	require.NoError(t, err)
+	require.Equal(t, "x", env.Name)
+	require.NotNil(t, env.Inner)
+	require.Equal(t, 2, env.Inner.Count)
+	require.Equal(t, int32(5e8), env.Inner.At.GetNanos())
+	require.Equal(t, int64(1693267200), env.Stamp.GetSeconds())
+	require.Equal(t, "s", env.Values["v"].GetStringValue())
+	require.Contains(t, env.Values, "n")
+	require.Nil(t, env.Values["n"])
+	require.Len(t, env.Items, 2)
+	require.Equal(t, int32(5e8), env.Items[0].GetNanos())
+	require.Nil(t, env.Items[1])
+
+	env = testEnvelope{}
+	require.NoError(t, marshaler.Unmarshal([]byte(`{"name":"y","inner":null}`), &env))
+	require.Nil(t, env.Inner)
+	require.Nil(t, env.Stamp)
+
+	env = testEnvelope{Inner: &testInner{Count: 1}, Stamp: timestamppb.Now()}
+	require.NoError(t, marshaler.Unmarshal([]byte(`{"inner":null,"stamp":null}`), &env))
+	require.Nil(t, env.Inner)
+	require.Nil(t, env.Stamp)
+
+	require.Error(t, marshaler.Unmarshal([]byte(`{"stamp":"yesterday"}`), &env))
+}
+
+func TestDecoderWrapperDecode(t *testing.T) {
+	stream := strings.NewReader(`
+		{"createdAt": "2023-08-29T00:00:00.250Z", "extra": {"@type": "type.googleapis.com/google.protobuf.Duration", "value": "2s"}}
+		{"attrs": {"k": [1, "two", null]}}
+		{"stamp": "2023-08-29T00:00:01.5Z"}
+		{"plain": 1}
+	`)
+	dec := (&JSONPb{}).NewDecoder(stream)
+
+	first := sampleType.New().Interface()
+	require.NoError(t, dec.Decode(first))
+	want := newMessage(t, sampleType, `{"createdAt": "2023-08-29T00:00:00.250Z", "extra": {"@type": "type.googleapis.com/google.protobuf.Duration", "value": "2s"}}`)
+	require.True(t, proto.Equal(want, first), "got %v", first)
+
+	second := sampleType.New().Interface()
+	require.NoError(t, dec.Decode(second))
+	want = newMessage(t, sampleType, `{"attrs": {"k": [1, "two", null]}}`)
+	require.True(t, proto.Equal(want, second), "got %v", second)
+
+	var env testEnvelope
+	require.NoError(t, dec.Decode(&env))
+	require.Equal(t, int32(5e8), env.Stamp.GetNanos())
+
+	var plain map[string]int
+	require.NoError(t, dec.Decode(&plain))
+	require.Equal(t, map[string]int{"plain": 1}, plain)
+
+	require.Equal(t, io.EOF, dec.Decode(sampleType.New().Interface()))
+}
+
+func TestJSONPbProtoJSONUnmarshalOptions(t *testing.T) {
+	marshaler := &JSONPb{
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		Decoding:         DecodingOptions{SparseRepeated: true},
+	}
+	src := `{"tags": {"1": "x"}, "unknown": 1}`
+	want := newMessage(t, sampleType, `{"tags": ["", "x"]}`)
+
+	m := sampleType.New().Interface()
+	require.NoError(t, marshaler.Unmarshal([]byte(src), m))
+	require.True(t, proto.Equal(want, m), "got %v", m)
+
+	m = sampleType.New().Interface()
+	require.NoError(t, marshaler.NewDecoder(strings.NewReader(src)).Decode(m))
+	require.True(t, proto.Equal(want, m), "got %v", m)
+
+	marshaler.UnmarshalOptions.DiscardUnknown = false
+	require.Error(t, marshaler.Unmarshal([]byte(src), sampleType.New().Interface()))
+}
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestJSONPbMarshalTo(t *testing.T) {
+	marshaler := &JSONPb{}
+	m := newMessage(t, sampleType, `{"id":"a","managerId":"18014398509481984","createdAt":"2023-08-29T00:00:00Z"}`)
+
+	var response, audit countingWriter
+	require.NoError(t, marshaler.MarshalTo(m, &response, &audit))
+
+	expected, err := marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, expected, response.Bytes())
+	require.Equal(t, expected, audit.Bytes())
+	require.Equal(t, 1, response.writes)
+	require.Equal(t, 1, audit.writes)
+}
+
+func TestJSONPbIndent(t *testing.T) {
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{Indent: "  "}}
+	m := newMessage(t, sampleType, `{
+		"id": "a",
+		"tags": [],
+		"nested": {"name": "n", "child": {"count": "2"}},
+		"extra": {"@type": "type.googleapis.com/google.protobuf.Struct", "value": {"k": {}, "l": [1]}},
+		"attrs": {}
+	}`)
+
+	expected := `{
+  "id": "a",
+  "nested": {
+    "name": "n",
+    "child": {
+      "count": 2
+    }
+  },
+  "extra": {
+    "@type": "type.googleapis.com/google.protobuf.Struct",
+    "value": {
+      "k": {},
+      "l": [
+        1
+      ]
+    }
+  },
+  "attrs": {}
+}`
+	actual, err := marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(actual))
+
+	// The stream encoder adds exactly one delimiter.
+	var buf bytes.Buffer
+	require.NoError(t, marshaler.NewEncoder(&buf).Encode(m))
+	require.Equal(t, expected+"\n", buf.String())
+
+	// Non-proto values are indented the same way.
+	actual, err = marshaler.Marshal(map[string]interface{}{"a": map[string]int{"b": 1}, "c": []int{}})
+	require.NoError(t, err)
+	require.Equal(t, "{\n  \"a\": {\n    \"b\": 1\n  },\n  \"c\": []\n}", string(actual))
+
+	// Invalid options are rejected for either kind of value.
+	marshaler = &JSONPb{MarshalOptions: MarshalOptions{Indent: "x"}}
+	_, err = marshaler.Marshal(m)
+	require.Error(t, err)
+	_, err = marshaler.Marshal(map[string]int{"a": 1})
+	require.Error(t, err)
+}
+
+type testIDs struct {
+	ID      int64            `json:"id"`
+	Parent  *int64           `json:"parent,omitempty"`
+	Small   int32            `json:"small"`
+	Unsign  uint64           `json:"unsigned"`
+	Members []int64          `json:"members"`
+	ByName  map[string]int64 `json:"byName"`
+	Name    string
+	Skipped int64 `json:"-"`
+	testEmbedded
+}
+
+type testEmbedded struct {
+	Embedded int64 `json:"embedded"`
+}
+
+func TestJSONPbInt64AsStringNonProto(t *testing.T) {
+	v := testIDs{
+		ID:           1 << 54,
+		Small:        1,
+		Unsign:       1 << 63,
+		Members:      []int64{1, 2},
+		ByName:       map[string]int64{"b": 2, "a": 1},
+		Name:         "n",
+		Skipped:      9,
+		testEmbedded: testEmbedded{Embedded: 5},
+	}
+
+	actual, err := (&JSONPb{}).Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":18014398509481984,"small":1,"unsigned":9223372036854775808,"members":[1,2],`+
+		`"byName":{"a":1,"b":2},"Name":"n","embedded":5}`, string(actual))
+
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{Int64AsString: true}}
+	actual, err = marshaler.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"18014398509481984","small":1,"unsigned":"9223372036854775808","members":["1","2"],`+
+		`"byName":{"a":"1","b":"2"},"Name":"n","embedded":"5"}`, string(actual))
+
+	parent := int64(3)
+	v.Parent = &parent
+	v.Members = nil
+	actual, err = marshaler.Marshal(&v)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"18014398509481984","parent":"3","small":1,"unsigned":"9223372036854775808","members":null,`+
+		`"byName":{"a":"1","b":"2"},"Name":"n","embedded":"5"}`, string(actual))
+
+	// Values without 64-bit integers are left to encoding/json.
+	actual, err = marshaler.Marshal(map[string]int32{"x": 1})
+	require.NoError(t, err)
+	require.Equal(t, `{"x":1}`, string(actual))
+
+	// Maps with other keys have their keys named as by encoding/json.
+	byID := map[int64]int64{1 << 60: 1 << 60, 2: -3}
+	want, err := stdjson.Marshal(byID)
+	require.NoError(t, err)
+	actual, err = (&JSONPb{}).Marshal(byID)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(actual))
+	actual, err = marshaler.Marshal(byID)
+	require.NoError(t, err)
+	require.Equal(t, `{"1152921504606846976":"1152921504606846976","2":"-3"}`, string(actual))
+}
+
+func TestJSONPbMarshalConcurrent(t *testing.T) {
+	marshaler := &JSONPb{}
+
+	const goroutines, iterations = 16, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 1; g <= goroutines; g++ {
+		m := newMessage(t, nestedType, fmt.Sprintf(`{"name":"n%d","count":"%d"}`, g, g))
+		want := fmt.Sprintf(`{"name":"n%d","count":%d}`, g, g)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var results [][]byte
+			for i := 0; i < iterations; i++ {
+				actual, err := marshaler.Marshal(m)
+				if err != nil {
+					errs <- err
+					return
+				}
+				results = append(results, actual)
+			}
+			// Results must stay intact once their buffers went back to the pool.
+			for _, actual := range results {
+				if string(actual) != want {
+					errs <- fmt.Errorf("got %s, want %s", actual, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func BenchmarkJSONPbMarshal(b *testing.B) {
+	marshaler := &JSONPb{}
+	m := newMessage(b, sampleType, `{"id":"a","managerId":"7","tags":["x","y"],"nested":{"name":"n","count":"2"}}`)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := marshaler.Marshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+const testTenantProtoFile = `
+name: "jsonpb/tenant.proto"
+package: "jsonpb.test.tenant"
+syntax: "proto3"
+message_type {
+  name: "Widget"
+  field { name: "widget_id" number: 1 label: LABEL_OPTIONAL type: TYPE_INT64 }
+  field { name: "label" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+`
+
+func TestJSONPbResolver(t *testing.T) {
+	files, types := new(protoregistry.Files), new(protoregistry.Types)
+	fd := registerTestFile(testTenantProtoFile, files, types)
+	widget := dynamicpb.NewMessage(fd.Messages().ByName("Widget"))
+	require.NoError(t, protojson.Unmarshal([]byte(`{"widgetId":"7","label":"w"}`), widget))
+	extra, err := anypb.New(widget)
+	require.NoError(t, err)
+	m := sampleType.New()
+	m.Set(m.Descriptor().Fields().ByName("extra"), protoreflect.ValueOfMessage(extra.ProtoReflect()))
+
+	_, err = (&JSONPb{}).Marshal(m.Interface())
+	require.Error(t, err, "the type is not in the global registry")
+
+	marshaler := &JSONPb{
+		MarshalOptions:   MarshalOptions{Resolver: types},
+		UnmarshalOptions: protojson.UnmarshalOptions{Resolver: types},
+	}
+	actual, err := marshaler.Marshal(m.Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"extra":{"@type":"type.googleapis.com/jsonpb.test.tenant.Widget","widgetId":7,"label":"w"}}`, string(actual))
+
+	got := sampleType.New().Interface()
+	require.NoError(t, marshaler.Unmarshal(actual, got))
+
+	// The Any values are compared as bytes by proto.Equal, and the field order
+	// of those is not stable for dynamic messages, so compare their contents.
+	gotExtra := got.ProtoReflect().Get(m.Descriptor().Fields().ByName("extra")).Message()
+	anyFields := gotExtra.Descriptor().Fields()
+	require.Equal(t, extra.GetTypeUrl(), gotExtra.Get(anyFields.ByName("type_url")).String())
+	gotWidget := dynamicpb.NewMessage(widget.Descriptor())
+	require.NoError(t, proto.Unmarshal(gotExtra.Get(anyFields.ByName("value")).Bytes(), gotWidget))
+	require.True(t, proto.Equal(widget, gotWidget), "got %v", gotWidget)
+}
+
+type testSchedule struct {
+	Starts map[string]time.Time              `json:"starts"`
+	Stamps map[string]*timestamppb.Timestamp `json:"stamps"`
+}
+
+func TestJSONPbMarshalTimeMaps(t *testing.T) {
+	at := time.Date(2023, 8, 29, 1, 2, 3, 500000000, time.FixedZone("X", 3600))
+	v := testSchedule{
+		Starts: map[string]time.Time{"b": at, "a_key": at.Add(time.Second)},
+		Stamps: map[string]*timestamppb.Timestamp{"b": timestamppb.New(at), "a": nil},
+	}
+
+	actual, err := (&JSONPb{}).Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"starts":{"a_key":"2023-08-29T00:02:04.500Z","b":"2023-08-29T00:02:03.500Z"},"stamps":{"a":null,"b":"2023-08-29T00:02:03.500Z"}}`, string(actual))
+
+	actual, err = (&JSONPb{MarshalOptions: MarshalOptions{TimestampFractionDigits: FractionDigits(6)}}).Marshal(v.Starts)
+	require.NoError(t, err)
+	require.Equal(t, `{"a_key":"2023-08-29T00:02:04.500000Z","b":"2023-08-29T00:02:03.500000Z"}`, string(actual))
+
+	// Map values are not made relative, and time.Time values outside of maps
+	// are left to encoding/json.
+	opts := MarshalOptions{TimestampFractionDigits: FractionDigits(6), TimestampsRelativeTo: at}
+	actual, err = (&JSONPb{MarshalOptions: opts}).Marshal(map[string]time.Time{"b": at})
+	require.NoError(t, err)
+	require.Equal(t, `{"b":"2023-08-29T00:02:03.500000Z"}`, string(actual))
+
+	note := struct {
+		At     time.Time
+		Stamp  *timestamppb.Timestamp
+		Starts map[string]time.Time `json:"starts,omitempty"`
+	}{At: at, Stamp: timestamppb.New(at)}
+	actual, err = (&JSONPb{}).Marshal(note)
+	require.NoError(t, err)
+	require.Equal(t, `{"at":"2023-08-29T01:02:03.5+01:00","stamp":"2023-08-29T00:02:03.500Z"}`, string(actual))
+
+	actual, err = (&JSONPb{MarshalOptions: opts}).Marshal([]time.Time{at})
+	require.NoError(t, err)
+	require.Equal(t, `["2023-08-29T01:02:03.5+01:00"]`, string(actual))
+}
+
+type testWKTEnvelope struct {
+	RequestID string `json:"request_id"`
+	Alias     *wrapperspb.StringValue
+	TTL       *durationpb.Duration
+	Attrs     *structpb.Struct
+	Missing   *timestamppb.Timestamp
+	Total     int64 `json:",omitempty"`
+}
+
+func TestJSONPbMarshalWKTEnvelope(t *testing.T) {
+	attrs, err := structpb.NewStruct(map[string]interface{}{"k": "v"})
+	require.NoError(t, err)
+	v := testWKTEnvelope{
+		RequestID: "r",
+		Alias:     wrapperspb.String("a"),
+		TTL:       durationpb.New(1500 * time.Millisecond),
+		Attrs:     attrs,
+	}
+
+	marshaler := &JSONPb{}
+	actual, err := marshaler.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"request_id":"r","alias":"a","ttl":"1.500s","attrs":{"k":"v"},"missing":null}`, string(actual))
+
+	var got testWKTEnvelope
+	require.NoError(t, marshaler.Unmarshal(actual, &got))
+	require.Equal(t, "r", got.RequestID)
+	require.True(t, proto.Equal(v.TTL, got.TTL))
+	require.True(t, proto.Equal(v.Attrs, got.Attrs))
+	require.Nil(t, got.Missing)
+
+	st := &TestStruct{Id: "id", ManagerId: 1 << 54, CreatedAt: timestamppb.New(time.Date(2023, 8, 29, 0, 0, 0, 0, time.UTC))}
+	actual, err = (&JSONPb{MarshalOptions: MarshalOptions{Int64AsString: true}}).Marshal(st)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"id","createdAt":"2023-08-29T00:00:00Z","managerId":"18014398509481984"}`, string(actual))
+}
+
+type testQuotedEnvelope struct {
+	ID     int64   `json:"id,string"`
+	Parent *int64  `json:"parent,string"`
+	Flag   bool    `json:",string"`
+	Name   string  `json:"name,string"`
+	Tags   []int64 `json:"tags,string"`
+	Stamp  *timestamppb.Timestamp
+}
+
+func TestJSONPbMarshalStringOption(t *testing.T) {
+	at := time.Date(2023, 8, 29, 0, 0, 0, 0, time.UTC)
+	v := testQuotedEnvelope{ID: 5, Flag: true, Name: "n", Stamp: timestamppb.New(at)}
+
+	// The option applies to scalars, as in encoding/json, and not to slices.
+	want := `{"id":"5","parent":null,"flag":"true","name":"\"n\"","tags":null,"stamp":"2023-08-29T00:00:00Z"}`
+	for _, opts := range []MarshalOptions{{}, {Int64AsString: true}, {NilSliceAsEmptyArray: true}} {
+		actual, err := (&JSONPb{MarshalOptions: opts}).Marshal(v)
+		require.NoError(t, err)
+		if opts.NilSliceAsEmptyArray {
+			require.Equal(t, strings.Replace(want, `"tags":null`, `"tags":[]`, 1), string(actual))
+		} else {
+			require.Equal(t, want, string(actual))
+		}
+	}
+
+	plain, err := stdjson.Marshal(struct {
+		ID   int64  `json:"id,string"`
+		Flag bool   `json:",string"`
+		Name string `json:"name,string"`
+	}{v.ID, v.Flag, v.Name})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"5","Flag":"true","name":"\"n\""}`, string(plain))
+
+	parent := int64(1 << 60)
+	v.Parent = &parent
+	actual, err := (&JSONPb{MarshalOptions: MarshalOptions{Int64AsString: true}}).Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"5","parent":"1152921504606846976","flag":"true","name":"\"n\"","tags":null,"stamp":"2023-08-29T00:00:00Z"}`, string(actual))
+
+	var got testQuotedEnvelope
+	require.NoError(t, (&JSONPb{}).Unmarshal(actual, &got))
+	require.Equal(t, v.ID, got.ID)
+	require.Equal(t, parent, *got.Parent)
+	require.Equal(t, v.Flag, got.Flag)
+	require.Equal(t, v.Name, got.Name)
+	require.True(t, proto.Equal(v.Stamp, got.Stamp))
+}
+
+func TestJSONPbRootKey(t *testing.T) {
+	marshaler := &JSONPb{
+		MarshalOptions: MarshalOptions{RootKey: "payload"},
+		Decoding:       DecodingOptions{RootKey: "payload"},
+	}
+	m := newMessage(t, sampleType, `{"id":"a","nested":{"name":"n"}}`)
+
+	actual, err := marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"payload":{"id":"a","nested":{"name":"n"}}}`, string(actual))
+
+	got := sampleType.New().Interface()
+	require.NoError(t, marshaler.Unmarshal(actual, got))
+	require.True(t, proto.Equal(m, got), "got %v", got)
+
+	marshaler.Indent = "  "
+	actual, err = marshaler.Marshal(newMessage(t, sampleType, `{"id":"a"}`))
+	require.NoError(t, err)
+	require.Equal(t, "{\n  \"payload\": {\n    \"id\": \"a\"\n  }\n}", string(actual))
+
+	for _, src := range []string{`{"id":"a"}`, `{"payload":{},"meta":{}}`, `null`, `[]`, `{"payload":{"id":"a"},"payload":{"id":"b"}}`} {
+		require.Error(t, marshaler.Unmarshal([]byte(src), sampleType.New().Interface()), src)
+	}
+}
+
+type testNote struct {
+	Text string
+	At   *timestamppb.Timestamp `json:"at,omitempty"`
+}
+
+func TestJSONPbLineSeparators(t *testing.T) {
+	// The text ends in a backslash followed by "u2028", which must be left alone.
+	const text = "a\u2028b\u2029c\\u2028"
+	const escaped, raw = `"a\u2028b\u2029c\\u2028"`, "\"a\u2028b\u2029c\\\\u2028\""
+
+	m := newMessage(t, sampleType, `{"id":`+escaped+`}`)
+	tests := []struct {
+		v    interface{}
+		want string // with %s for the string
+	}{
+		{m, `{"id":%s}`},
+		{map[string]string{"text": text}, `{"text":%s}`},
+		{testNote{Text: text, At: &timestamppb.Timestamp{}}, `{"text":%s,"at":"1970-01-01T00:00:00Z"}`},
+		{[]interface{}{text, m}, `[%s,{"id":%[1]s}]`},
+	}
+	for _, tt := range tests {
+		actual, err := (&JSONPb{}).Marshal(tt.v)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf(tt.want, escaped), string(actual))
+
+		actual, err = (&JSONPb{MarshalOptions: MarshalOptions{AllowLineSeparators: true}}).Marshal(tt.v)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf(tt.want, raw), string(actual))
+	}
+}
+
+func TestJSONPbNDJSON(t *testing.T) {
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{Indent: "  "}}
+	require.Equal(t, "application/json", marshaler.ContentType(nil))
+
+	marshaler.NDJSON = true
+	require.Equal(t, "application/x-ndjson", marshaler.ContentType(nil))
+
+	var buf bytes.Buffer
+	enc := marshaler.NewEncoder(&buf)
+	require.NoError(t, enc.Encode(newMessage(t, nestedType, `{"name":"a","child":{"name":"b"}}`)))
+	require.NoError(t, enc.Encode(map[string][]int{"n": {1, 2}}))
+	require.Equal(t, "{\"name\":\"a\",\"child\":{\"name\":\"b\"}}\n{\"n\":[1,2]}\n", buf.String())
+
+	marshaler.NDJSONContentType = "application/jsonl"
+	require.Equal(t, "application/jsonl", marshaler.ContentType(nil))
+}
+
+type testOptional struct {
+	Nickname *wrapperspb.StringValue `json:",omitempty"`
+	Age      *wrapperspb.Int32Value  `json:"age,omitempty"`
+	Verified *wrapperspb.BoolValue
+}
+
+func TestJSONPbOmitEmptyWrappers(t *testing.T) {
+	marshaler := &JSONPb{}
+
+	actual, err := marshaler.Marshal(testOptional{})
+	require.NoError(t, err)
+	require.Equal(t, `{"verified":null}`, string(actual))
+
+	actual, err = marshaler.Marshal(testOptional{Nickname: wrapperspb.String(""), Age: wrapperspb.Int32(3), Verified: wrapperspb.Bool(true)})
+	require.NoError(t, err)
+	require.Equal(t, `{"nickname":"","age":3,"verified":true}`, string(actual))
+}
+
+func TestJSONPbSequenceDecoder(t *testing.T) {
+	stream := strings.NewReader("\x1e{\"id\":\"a\",\"managerId\":\"7\"}\n\x1e\x1e{\"id\":\"b\"}\n\x1e{\"id\":\"c\"}")
+	dec := (&JSONPb{}).NewSequenceDecoder(stream)
+
+	for _, want := range []string{`{"id":"a","managerId":"7"}`, `{"id":"b"}`, `{"id":"c"}`} {
+		got := sampleType.New().Interface()
+		require.NoError(t, dec.Decode(got))
+		require.True(t, proto.Equal(newMessage(t, sampleType, want), got), "got %v", got)
+	}
+	require.Equal(t, io.EOF, dec.Decode(sampleType.New().Interface()))
+
+	// A separator within a string ends the record, rather than being read as
+	// part of the string; escaped, it is fine.
+	dec = (&JSONPb{}).NewSequenceDecoder(strings.NewReader("\x1e{\"id\":\"a\x1eb\"}\n\x1e{\"id\":\"a\\u001eb\"}\n"))
+	require.Error(t, dec.Decode(sampleType.New().Interface()))
+
+	dec = (&JSONPb{}).NewSequenceDecoder(strings.NewReader("{\"id\":\"a\\u001eb\"}\n{\"id\":\"c\"}"))
+	for _, want := range []string{"a\x1eb", "c"} {
+		var got struct{ ID string }
+		require.NoError(t, dec.Decode(&got))
+		require.Equal(t, want, got.ID)
+	}
+	require.Equal(t, io.EOF, dec.Decode(sampleType.New().Interface()))
+}
+
+type testSlices struct {
+	Tags     []string         `json:"tags"`
+	Data     []byte           `json:"data"`
+	Children []*testSlices    `json:"children"`
+	Matrix   map[string][]int `json:"matrix"`
+	Skipped  []string         `json:"skipped,omitempty"`
+}
+
+func TestJSONPbNilSliceAsEmptyArray(t *testing.T) {
+	value := testSlices{Children: []*testSlices{{Tags: []string{}}}, Matrix: map[string][]int{"a": nil, "b": {}}}
+
+	actual, err := (&JSONPb{}).Marshal(value)
+	require.NoError(t, err)
+	require.Equal(t, `{"tags":null,"data":null,"children":[{"tags":[],"data":null,"children":null,"matrix":null}],"matrix":{"a":null,"b":[]}}`, string(actual))
+
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{NilSliceAsEmptyArray: true}}
+	actual, err = marshaler.Marshal(value)
+	require.NoError(t, err)
+	require.Equal(t, `{"tags":[],"data":null,"children":[{"tags":[],"data":null,"children":[],"matrix":null}],"matrix":{"a":[],"b":[]}}`, string(actual))
+
+	for _, v := range []interface{}{[]string(nil), []string{}, []*timestamppb.Timestamp(nil)} {
+		actual, err = marshaler.Marshal(v)
+		require.NoError(t, err)
+		require.Equal(t, `[]`, string(actual))
+	}
+	actual, err = marshaler.Marshal([]byte(nil))
+	require.NoError(t, err)
+	require.Equal(t, `null`, string(actual))
+}
+
+type testStrings struct {
+	Name   string
+	Tags   []string
+	Labels map[string]string
+	Alias  *string
+	Amount stdjson.Number
+	At     *timestamppb.Timestamp
+}
+
+func TestJSONPbRejectsNumbersForStrings(t *testing.T) {
+	marshaler := &JSONPb{}
+	for _, src := range []string{
+		`{"Name":1}`,
+		`{"name":1.5}`,
+		`{"Tags":["a",2]}`,
+		`{"Labels":{"a":1}}`,
+		`{"Alias":1}`,
+		`{"Name":true}`,
+	} {
+		var v testStrings
+		require.Error(t, marshaler.Unmarshal([]byte(src), &v), src)
+	}
+
+	var s string
+	require.Error(t, marshaler.Unmarshal([]byte(`1`), &s))
+
+	var v testStrings
+	require.NoError(t, marshaler.Unmarshal([]byte(`{"Name":"1","Amount":1.5,"At":"2023-08-29T00:00:00Z"}`), &v))
+	require.Equal(t, "1", v.Name)
+	require.Equal(t, stdjson.Number("1.5"), v.Amount)
+}
+
+type testSnakeInner struct {
+	DisplayName string `json:"displayName"`
+}
+
+type testSnake struct {
+	UserID    string `json:"userId"`
+	ManagerId int64
+	Inner     testSnakeInner `json:"innerValue"`
+	Labels    map[string]string
+}
+
+func TestJSONPbTopLevelSnakeCase(t *testing.T) {
+	marshaler := &JSONPb{MarshalOptions: MarshalOptions{TopLevelSnakeCase: true}}
+
+	m := newMessage(t, sampleType, `{"managerId":"1","createdAt":"2023-08-29T00:00:00Z","nested":{"name":"a","child":{"name":"b"}},"children":[{"count":"2"}],"labels":{"1":"a"},"attrs":{"someKey":{"innerKey":1}}}`)
+	actual, err := marshaler.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"manager_id":1,"nested":{"name":"a","child":{"name":"b"}},"children":[{"count":2}],"created_at":"2023-08-29T00:00:00Z","attrs":{"someKey":{"innerKey":1}},"labels":{"1":"a"}}`, string(actual))
+
+	v := testSnake{UserID: "u", ManagerId: 2, Inner: testSnakeInner{DisplayName: "d"}, Labels: map[string]string{"someKey": "v"}}
+	for _, v := range []interface{}{v, &v} {
+		actual, err = marshaler.Marshal(v)
+		require.NoError(t, err)
+		require.Equal(t, `{"user_id":"u","manager_id":2,"inner_value":{"displayName":"d"},"labels":{"someKey":"v"}}`, string(actual))
+	}
+
+	actual, err = marshaler.Marshal(TestStruct{Id: "x", CreatedAt: timestamppb.New(time.Unix(0, 0)), ManagerId: 3})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"x","created_at":"1970-01-01T00:00:00Z","manager_id":3}`, string(actual))
+
+	actual, err = (&JSONPb{}).Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"userId":"u","ManagerId":2,"innerValue":{"displayName":"d"},"Labels":{"someKey":"v"}}`, string(actual))
+}
@@ -0,0 +1,95 @@
+package jsonpb
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+
+	"jsonpb/encoding/json"
+	"jsonpb/errors"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MarshalMerged writes the messages as a single JSON object using default
+// options. See MarshalOptions.MarshalMerged.
+func MarshalMerged(msgs ...proto.Message) ([]byte, error) {
+	return MarshalOptions{}.MarshalMerged(msgs...)
+}
+
+// MarshalMerged marshals each of msgs and merges the members of the resulting
+// JSON objects into one, for composing a response from partial ones. The merge
+// is shallow: a member of a later message replaces the member of the same name
+// of an earlier one as a whole, in its original position. It is an error if a
+// message is not written as a JSON object, as is the case for some well-known
+// types.
+func (o MarshalOptions) MarshalMerged(msgs ...proto.Message) ([]byte, error) {
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+	indent := o.Indent
+	o.Multiline, o.Indent = false, ""
+
+	var names []string
+	members := map[string]stdjson.RawMessage{}
+	for _, m := range msgs {
+		b, err := o.marshal(nil, m, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := rangeMembers(b, func(name string, v stdjson.RawMessage) {
+			if _, ok := members[name]; !ok {
+				names = append(names, name)
+			}
+			members[name] = v
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			name := "<nil>"
+			if m != nil {
+				name = string(m.ProtoReflect().Descriptor().FullName())
+			}
+			return nil, errors.New("cannot merge %v: not written as a JSON object", name)
+		}
+	}
+
+	enc, err := json.NewEncoder(nil, indent)
+	if err != nil {
+		return nil, err
+	}
+	enc.SetAllowLineSeparators(o.AllowLineSeparators)
+	enc.StartObject()
+	for _, name := range names {
+		if err := enc.WriteName(name); err != nil {
+			return nil, err
+		}
+		if err := enc.WriteRawValue(members[name]); err != nil {
+			return nil, err
+		}
+	}
+	enc.EndObject()
+	return enc.Bytes(), nil
+}
+
+// rangeMembers calls fn with the name and value of every member of the JSON
+// object b, in order. It reports false if b is not an object.
+func rangeMembers(b []byte, fn func(name string, v stdjson.RawMessage)) (bool, error) {
+	d := stdjson.NewDecoder(bytes.NewReader(b))
+	if tok, err := d.Token(); err != nil || tok != stdjson.Delim('{') {
+		return false, nil
+	}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return false, err
+		}
+		var v stdjson.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return false, err
+		}
+		fn(tok.(string), v)
+	}
+	return true, nil
+}
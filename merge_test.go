@@ -0,0 +1,32 @@
+package jsonpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMarshalMerged(t *testing.T) {
+	first := newMessage(t, sampleType, `{"id":"a","managerId":"7","nested":{"name":"n","count":"1"}}`)
+	second := newMessage(t, sampleType, `{"id":"b","tags":["x"],"nested":{"name":"m"}}`)
+
+	actual, err := MarshalMerged(first, second)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"b","managerId":7,"nested":{"name":"m"},"tags":["x"]}`, string(actual))
+
+	actual, err = MarshalMerged(first, newMessage(t, nestedType, `{"count":"3"}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a","managerId":7,"nested":{"name":"n","count":1},"count":3}`, string(actual))
+
+	actual, err = MarshalOptions{Indent: "  "}.MarshalMerged(second, nil)
+	require.NoError(t, err)
+	require.Equal(t, "{\n  \"id\": \"b\",\n  \"tags\": [\n    \"x\"\n  ],\n  \"nested\": {\n    \"name\": \"m\"\n  }\n}", string(actual))
+
+	actual, err = MarshalMerged()
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(actual))
+
+	_, err = MarshalMerged(first, timestamppb.Now())
+	require.Error(t, err)
+}
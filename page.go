@@ -0,0 +1,172 @@
+package jsonpb
+
+import (
+	"reflect"
+
+	"jsonpb/errors"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// paginationFields are the fields a message may have besides its repeated
+// field to be taken for a list response, as in https://google.aip.dev/158.
+var paginationFields = map[protoreflect.Name]bool{
+	"next_page_token":     true,
+	"previous_page_token": true,
+	"total_size":          true,
+}
+
+// pageKeys returns the names of the members of the envelope written with
+// Paginate.
+func (o MarshalOptions) pageKeys() (items, count string) {
+	items, count = o.PageItemsKey, o.PageCountKey
+	if items == "" {
+		items = "items"
+	}
+	if count == "" {
+		count = "count"
+	}
+	return items, count
+}
+
+// pageField returns the repeated field of a top-level message of type md that
+// is written as the items of the envelope, or nil if there is none. That is the
+// case unless Paginate is set and md is a list response: a message with
+// exactly one repeated field, not counting maps, which is not left out by
+// MarshalInclude, and no fields other than pagination fields unless md is
+// listed in PageTypes. Well-known types are never wrapped.
+func (e encoder) pageField(md protoreflect.MessageDescriptor) protoreflect.FieldDescriptor {
+	if !e.opts.Paginate || isWellKnown(md.FullName()) {
+		return nil
+	}
+	listed := false
+	for _, name := range e.opts.PageTypes {
+		listed = listed || name == md.FullName()
+	}
+	var list protoreflect.FieldDescriptor
+	fds := md.Fields()
+	for i := 0; i < fds.Len(); i++ {
+		switch fd := fds.Get(i); {
+		case fd.IsList():
+			if list != nil {
+				return nil
+			}
+			list = fd
+		case !listed && !paginationFields[fd.Name()]:
+			return nil
+		}
+	}
+	if list == nil {
+		return nil
+	}
+	if e.include != nil {
+		if _, ok := e.include[list.Number()]; !ok {
+			return nil
+		}
+	}
+	return list
+}
+
+// marshalPage marshals m into the envelope, with the repeated field fd as its
+// items followed by the other fields of m and, with EmitPresenceMask, by the
+// presence mask.
+func (e encoder) marshalPage(m protoreflect.Message, fd protoreflect.FieldDescriptor) error {
+	e.StartObject()
+	defer e.EndObject()
+
+	items, count := e.opts.pageKeys()
+	if e.tooManyFields(2) {
+		return e.maxFieldsError(m.Descriptor())
+	}
+	list := m.Get(fd)
+	fe := e
+	fe.presence, fe.snakeCase = false, false
+	if e.include != nil {
+		fe.include = e.include[fd.Number()]
+	}
+	if e.opts.RedactFunc != nil {
+		fe.path = e.fieldPath(items)
+	}
+	if err := e.WriteName(items); err != nil {
+		return err
+	}
+	if err := fe.marshalValue(list, fd); err != nil {
+		return fieldError(err, items)
+	}
+	if err := e.WriteName(count); err != nil {
+		return err
+	}
+	e.WriteInt(int64(list.List().Len()))
+	n, err := e.rangePageFields(m, fd, 2, func(fe encoder, fd protoreflect.FieldDescriptor, v protoreflect.Value, name string) error {
+		if err := e.WriteName(name); err != nil {
+			return err
+		}
+		if err := fe.marshalValue(v, fd); err != nil {
+			return fieldError(err, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if e.presence {
+		if e.tooManyFields(n + 1) {
+			return e.maxFieldsError(m.Descriptor())
+		}
+		if err := e.WriteName(presenceMaskName); err != nil {
+			return err
+		}
+		return e.marshalPresenceMask(m, e.include, fd)
+	}
+	return nil
+}
+
+// rangePageFields is rangeFields for the fields of m written next to the items
+// fd of the envelope. A field named like a member of the envelope is an error.
+func (e encoder) rangePageFields(m protoreflect.Message, fd protoreflect.FieldDescriptor, n int,
+	f func(fe encoder, fd protoreflect.FieldDescriptor, v protoreflect.Value, name string) error) (int, error) {
+	items, count := e.opts.pageKeys()
+	return e.rangeFields(m, fd, n, func(fe encoder, fd protoreflect.FieldDescriptor, v protoreflect.Value, name string) error {
+		if name == items || name == count {
+			return errors.New("%v: field %v is written as %q, like a member of the page envelope", m.Descriptor().FullName(), fd.Name(), name)
+		}
+		return f(fe, fd, v, name)
+	})
+}
+
+// isPageType reports whether Go values of type t are wrapped in the envelope
+// written with Paginate: slices and arrays, except byte slices, which
+// encoding/json writes as strings.
+func isPageType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// marshalReflectPage marshals the Go slice or array rv into the envelope. A nil
+// slice is written as an empty array.
+func (e encoder) marshalReflectPage(rv reflect.Value) error {
+	e.StartObject()
+	defer e.EndObject()
+
+	items, count := e.opts.pageKeys()
+	if err := e.WriteName(items); err != nil {
+		return err
+	}
+	e.StartArray()
+	for i := 0; i < rv.Len(); i++ {
+		if err := e.marshalReflectValue(rv.Index(i)); err != nil {
+			return err
+		}
+	}
+	e.EndArray()
+	if err := e.WriteName(count); err != nil {
+		return err
+	}
+	e.WriteInt(int64(rv.Len()))
+	return nil
+}
@@ -0,0 +1,177 @@
+package jsonpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testPageProtoFile = `
+name: "jsonpb/page.proto"
+package: "jsonpb.test.page"
+syntax: "proto3"
+dependency: "jsonpb/test.proto"
+message_type {
+  name: "ListNestedResponse"
+  field { name: "nested" number: 1 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".jsonpb.test.Nested" }
+  field { name: "next_page_token" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "totals" number: 3 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".jsonpb.test.page.ListNestedResponse.TotalsEntry" }
+  nested_type {
+    name: "TotalsEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+    options { map_entry: true }
+  }
+}
+message_type {
+  name: "ListTagsResponse"
+  field { name: "tags" number: 1 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "next_page_token" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "total_size" number: 3 label: LABEL_OPTIONAL type: TYPE_INT32 }
+}
+message_type {
+  name: "User"
+  field { name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "roles" number: 2 label: LABEL_REPEATED type: TYPE_STRING }
+}
+message_type {
+  name: "CountedList"
+  field { name: "items" number: 1 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "count" number: 2 label: LABEL_OPTIONAL type: TYPE_INT32 }
+}
+`
+
+func newListNestedResponseType(t *testing.T) protoreflect.MessageType {
+	t.Helper()
+	return newPageType(t, "ListNestedResponse")
+}
+
+// newPageType returns the type of the named message of testPageProtoFile.
+func newPageType(t *testing.T, name protoreflect.Name) protoreflect.MessageType {
+	t.Helper()
+	fd := registerTestFile(testPageProtoFile, new(protoregistry.Files), new(protoregistry.Types))
+	return dynamicpb.NewMessageType(fd.Messages().ByName(name))
+}
+
+func TestJSONPbPaginateSlice(t *testing.T) {
+	nested := newMessage(t, nestedType, `{"name":"a","count":"1"}`)
+	tests := []struct {
+		marshaler *JSONPb
+		v         interface{}
+		want      string
+	}{
+		{&JSONPb{}, []string{"a", "b"}, `["a","b"]`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, []string{"a", "b"}, `{"items":["a","b"],"count":2}`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, []string(nil), `{"items":[],"count":0}`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, [1]int{3}, `{"items":[3],"count":1}`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, []interface{}{nested, testInner{Count: 2}}, `{"items":[{"name":"a","count":1},{"at":null,"count":2}],"count":2}`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true, PageItemsKey: "results", PageCountKey: "total"}}, []int{1}, `{"results":[1],"total":1}`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, []byte("ab"), `"YWI="`},
+		{&JSONPb{MarshalOptions: MarshalOptions{Paginate: true}}, map[string]int{"a": 1}, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		actual, err := tt.marshaler.Marshal(tt.v)
+		require.NoError(t, err, tt.v)
+		require.Equal(t, tt.want, string(actual), tt.v)
+	}
+}
+
+func TestMarshalPaginateMessage(t *testing.T) {
+	mt := newListNestedResponseType(t)
+	// The response has fields besides pagination fields, so it must be listed.
+	pageTypes := []protoreflect.FullName{mt.Descriptor().FullName()}
+	m := newMessage(t, mt, `{
+		"nested": [{"name": "a"}, {"name": "b", "count": "2"}],
+		"nextPageToken": "t",
+		"totals": {"x": "1"}
+	}`)
+	tests := []struct {
+		opts MarshalOptions
+		want string
+	}{
+		{MarshalOptions{}, `{"nested":[{"name":"a"},{"name":"b","count":2}],"nextPageToken":"t","totals":{"x":1}}`},
+		{MarshalOptions{Paginate: true, PageTypes: pageTypes}, `{"items":[{"name":"a"},{"name":"b","count":2}],"count":2,"nextPageToken":"t","totals":{"x":1}}`},
+		{MarshalOptions{Paginate: true, PageTypes: pageTypes, PageItemsKey: "nested", PageCountKey: "size"}, `{"nested":[{"name":"a"},{"name":"b","count":2}],"size":2,"nextPageToken":"t","totals":{"x":1}}`},
+	}
+	for _, tt := range tests {
+		actual, err := tt.opts.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(actual))
+	}
+
+	actual, err := MarshalOptions{Paginate: true, PageTypes: pageTypes}.Marshal(mt.New().Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"items":[],"count":0}`, string(actual))
+
+	actual, err = MarshalOptions{Paginate: true, PageTypes: pageTypes}.MarshalInclude(m, []string{"nested.name"})
+	require.NoError(t, err)
+	require.Equal(t, `{"items":[{"name":"a"},{"name":"b"}],"count":2}`, string(actual))
+
+	// The presence mask follows the envelope, and is not written for items.
+	opts := MarshalOptions{Paginate: true, PageTypes: pageTypes, EmitPresenceMask: true}
+	actual, err = opts.Marshal(newMessage(t, mt, `{"nested":[{"name":"a"}],"nextPageToken":"t"}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"items":[{"name":"a"}],"count":1,"nextPageToken":"t","_fieldMask":{"items":true,"nextPageToken":true,"totals":false}}`, string(actual))
+	actual, err = opts.Marshal(mt.New().Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"items":[],"count":0,"_fieldMask":{"items":false,"nextPageToken":false,"totals":false}}`, string(actual))
+
+	// Unlisted, it is not a list response.
+	actual, err = MarshalOptions{Paginate: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"nested":[{"name":"a"},{"name":"b","count":2}],"nextPageToken":"t","totals":{"x":1}}`, string(actual))
+}
+
+func TestMarshalPaginateDetected(t *testing.T) {
+	// Only pagination fields are written next to the items.
+	m := newMessage(t, newPageType(t, "ListTagsResponse"), `{"tags":["a"],"nextPageToken":"t","totalSize":5}`)
+	actual, err := MarshalOptions{Paginate: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"items":["a"],"count":1,"nextPageToken":"t","totalSize":5}`, string(actual))
+
+	// A message with other fields is not a list response.
+	m = newMessage(t, newPageType(t, "User"), `{"name":"bob","roles":["admin"]}`)
+	actual, err = MarshalOptions{Paginate: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"bob","roles":["admin"]}`, string(actual))
+}
+
+func TestMarshalPaginateCollision(t *testing.T) {
+	mt := newPageType(t, "CountedList")
+	opts := MarshalOptions{Paginate: true, PageTypes: []protoreflect.FullName{mt.Descriptor().FullName()}}
+	m := newMessage(t, mt, `{"items":["a"],"count":5}`)
+	_, err := opts.Marshal(m)
+	require.Error(t, err)
+	_, err = opts.EmittedKeys(m)
+	require.Error(t, err)
+
+	// The items field itself is moved, and other names are fine.
+	m = newMessage(t, mt, `{"items":["a"]}`)
+	actual, err := opts.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"items":["a"],"count":1}`, string(actual))
+	opts.PageCountKey = "total"
+	actual, err = opts.Marshal(newMessage(t, mt, `{"items":["a"],"count":5}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"items":["a"],"total":1,"count":5}`, string(actual))
+
+	m = newMessage(t, newPageType(t, "ListTagsResponse"), `{"tags":["a"],"totalSize":5}`)
+	_, err = MarshalOptions{Paginate: true, PageCountKey: "totalSize"}.Marshal(m)
+	require.Error(t, err)
+	_, err = MarshalOptions{Paginate: true, PageItemsKey: "_fieldMask", EmitPresenceMask: true}.Marshal(m)
+	require.Error(t, err)
+}
+
+func TestMarshalPaginateNotAList(t *testing.T) {
+	// Sample has several repeated fields, none of which dominates.
+	m := newMessage(t, sampleType, `{"id":"a","tags":["x"]}`)
+	actual, err := MarshalOptions{Paginate: true}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a","tags":["x"]}`, string(actual))
+
+	_, err = MarshalOptions{Paginate: true, PageItemsKey: "count"}.Marshal(m)
+	require.Error(t, err)
+}
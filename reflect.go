@@ -0,0 +1,791 @@
+package jsonpb
+
+import (
+	"bytes"
+	"encoding"
+	stdjson "encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"jsonpb/encoding/json"
+	"jsonpb/errors"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var (
+	messageType       = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	marshalerType     = reflect.TypeOf((*stdjson.Marshaler)(nil)).Elem()
+	unmarshalerType   = reflect.TypeOf((*stdjson.Unmarshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+var (
+	containsMessageCache sync.Map // map[reflect.Type]bool
+	containsInt64Cache   sync.Map // map[reflect.Type]bool
+	containsTimeMapCache sync.Map // map[reflect.Type]bool
+	containsIfaceCache   sync.Map // map[reflect.Type]bool
+	containsSliceCache   sync.Map // map[reflect.Type]bool
+)
+
+// containsMessage reports whether values of type t hold proto messages,
+// either directly or through pointers, struct fields, slices, arrays or maps.
+func containsMessage(t reflect.Type) bool {
+	return typeContains(&containsMessageCache, t, func(t reflect.Type) bool {
+		return t.Implements(messageType)
+	})
+}
+
+// containsInt64 reports whether values of type t hold integers of kind int64
+// or uint64 outside of proto messages.
+func containsInt64(t reflect.Type) bool {
+	return typeContains(&containsInt64Cache, t, func(t reflect.Type) bool {
+		return t.Kind() == reflect.Int64 || t.Kind() == reflect.Uint64
+	})
+}
+
+// containsTimeMap reports whether values of type t hold maps of time.Time
+// values outside of proto messages.
+func containsTimeMap(t reflect.Type) bool {
+	return typeContains(&containsTimeMapCache, t, isTimeMap)
+}
+
+// containsInterface reports whether values of type t hold interface values,
+// the dynamic type of which is only known when marshaling.
+func containsInterface(t reflect.Type) bool {
+	return typeContains(&containsIfaceCache, t, func(t reflect.Type) bool {
+		return t.Kind() == reflect.Interface
+	})
+}
+
+// containsSlice reports whether values of type t hold slices other than
+// []byte, which encoding/json writes as a base64 string.
+func containsSlice(t reflect.Type) bool {
+	return typeContains(&containsSliceCache, t, func(t reflect.Type) bool {
+		return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+	})
+}
+
+// typeContains reports whether match holds for t or any type reachable from it
+// through pointers, struct fields, slices, arrays or maps. Proto messages and
+// types with their own JSON methods are not looked into. Results are cached.
+func typeContains(cache *sync.Map, t reflect.Type, match func(reflect.Type) bool) bool {
+	if v, ok := cache.Load(t); ok {
+		return v.(bool)
+	}
+	ok := walkTypeContains(t, match, map[reflect.Type]bool{})
+	cache.Store(t, ok)
+	return ok
+}
+
+func walkTypeContains(t reflect.Type, match func(reflect.Type) bool, seen map[reflect.Type]bool) bool {
+	if match(t) {
+		return true
+	}
+	if seen[t] || hasJSONMethods(t) || t.Implements(messageType) {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return walkTypeContains(t.Elem(), match, seen)
+	case reflect.Struct:
+		for _, f := range structFields(t) {
+			if walkTypeContains(f.typ, match, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasJSONMethods reports whether t, or a pointer to it, implements
+// json.Marshaler, json.Unmarshaler or encoding.TextMarshaler. Such types are
+// left to encoding/json.
+func hasJSONMethods(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return t.Implements(marshalerType) || pt.Implements(marshalerType) || pt.Implements(unmarshalerType) ||
+		t.Implements(textMarshalerType) || pt.Implements(textMarshalerType)
+}
+
+// structField describes a struct field as it appears in JSON. Fields of
+// embedded structs are promoted like encoding/json does.
+type structField struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	tagged    bool
+	omitEmpty bool
+
+	// quoted is set for the string option, which writes the value of a
+	// scalar field within a JSON string.
+	quoted bool
+}
+
+var structFieldsCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the JSON fields of the struct type t in declaration
+// order. It follows the encoding/json rules for the json struct tag.
+func structFields(t reflect.Type) []structField {
+	if v, ok := structFieldsCache.Load(t); ok {
+		return v.([]structField)
+	}
+	fields := collectStructFields(t, nil, map[reflect.Type]bool{})
+
+	// A field shadows the fields of the same name at a deeper level. Fields of
+	// the same name at the same level cancel each other out unless exactly one
+	// of them is tagged.
+	byName := map[string][]int{}
+	for i, f := range fields {
+		byName[f.name] = append(byName[f.name], i)
+	}
+	var out []structField
+	for i, f := range fields {
+		if dominantField(fields, byName[f.name]) == i {
+			out = append(out, f)
+		}
+	}
+	structFieldsCache.Store(t, out)
+	return out
+}
+
+func collectStructFields(t reflect.Type, index []int, seen map[reflect.Type]bool) []structField {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		idx := append(append([]int(nil), index...), i)
+
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, collectStructFields(ft, idx, seen)...)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		f := structField{
+			name:      name,
+			index:     idx,
+			typ:       sf.Type,
+			tagged:    name != "",
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+			quoted:    strings.Contains(","+opts+",", ",string,") && isQuotable(sf.Type),
+		}
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// isQuotable reports whether the string option of the json struct tag applies
+// to fields of type t, as it does in encoding/json: to booleans, numbers and
+// strings, and pointers to them, that do not marshal themselves.
+func isQuotable(t reflect.Type) bool {
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pt := reflect.PtrTo(t)
+	if t.Implements(marshalerType) || pt.Implements(marshalerType) || t.Implements(textMarshalerType) || pt.Implements(textMarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	}
+	return false
+}
+
+// dominantField returns the index of the field that wins among the fields of
+// the same name at the given indexes, or -1 if there is none.
+func dominantField(fields []structField, indexes []int) int {
+	best, depth, tagged, ambiguous := -1, 0, false, false
+	for _, i := range indexes {
+		f := fields[i]
+		switch {
+		case best < 0 || len(f.index) < depth || len(f.index) == depth && f.tagged && !tagged:
+			best, depth, tagged, ambiguous = i, len(f.index), f.tagged, false
+		case len(f.index) == depth && f.tagged == tagged:
+			ambiguous = true
+		}
+	}
+	if ambiguous {
+		return -1
+	}
+	return best
+}
+
+// isMessageMap reports whether t is a map with string keys and proto.Message
+// values.
+func isMessageMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && t.Elem().Implements(messageType)
+}
+
+// isTimeMap reports whether t is a map with string keys and time.Time values.
+func isTimeMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && t.Elem() == timeType
+}
+
+// marshalReflect appends the JSON encoding of v, which is not a proto.Message,
+// to b. Values that need it are walked by reflection: values holding messages
+// or maps of time.Time values, so that these are written as by the proto
+// encoder, values holding interfaces, which may hold either, and values
+// holding 64-bit integers under Int64AsString. Anything else is left to
+// encoding/json, including time.Time values outside of maps.
+//
+// The options must have been prepared, as for marshal.
+func (o MarshalOptions) marshalReflect(b []byte, v interface{}) ([]byte, error) {
+
+	rv := reflect.ValueOf(v)
+	page := o.Paginate && rv.IsValid() && isPageType(rv.Type())
+	snakeCase := o.TopLevelSnakeCase && rv.IsValid() && isStructType(rv.Type())
+	if !rv.IsValid() || !page && !snakeCase && !o.needsReflect(rv.Type()) {
+		var out []byte
+		var err error
+		if o.Indent != "" {
+			out, err = stdjson.MarshalIndent(v, "", o.Indent)
+		} else {
+			out, err = stdjson.Marshal(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o.AllowLineSeparators {
+			out = unescapeLineSeparators(out)
+		}
+		return append(b, out...), nil
+	}
+
+	if o.Resolver == nil {
+		o.Resolver = protoregistry.GlobalTypes
+	}
+
+	internalEnc, err := json.NewEncoder(b, o.Indent)
+	if err != nil {
+		return nil, err
+	}
+	internalEnc.SetAllowLineSeparators(o.AllowLineSeparators)
+	enc := encoder{Encoder: internalEnc, opts: o, snakeCase: snakeCase}
+	if page {
+		err = enc.marshalReflectPage(rv)
+	} else {
+		err = enc.marshalReflectValue(rv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := enc.Bytes()
+	if o.AllowLineSeparators {
+		// Values marshaled by encoding/json within have them escaped.
+		out = append(out[:len(b)], unescapeLineSeparators(out[len(b):])...)
+	}
+	return out, nil
+}
+
+// unescapeLineSeparators undoes the escaping of U+2028 and U+2029 that
+// encoding/json applies to the strings in the JSON document b, in place.
+func unescapeLineSeparators(b []byte) []byte {
+	if !bytes.Contains(b, []byte(`\u202`)) {
+		return b
+	}
+	out := b[:0]
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' || i+1 == len(b) {
+			out = append(out, b[i])
+			continue
+		}
+		if rest := b[i+1:]; bytes.HasPrefix(rest, []byte("u2028")) || bytes.HasPrefix(rest, []byte("u2029")) {
+			out = utf8.AppendRune(out, 0x2028+rune(b[i+5]-'8'))
+			i += 5
+			continue
+		}
+		// Copy other escape sequences as is, so that an escaped backslash
+		// is not taken for the start of an escape sequence.
+		out = append(out, b[i], b[i+1])
+		i++
+	}
+	return out
+}
+
+// isStructType reports whether t is a struct or a pointer to one, and does not
+// marshal itself.
+func isStructType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !hasJSONMethods(t) && !t.Implements(messageType)
+}
+
+// needsReflect reports whether values of type t must be walked by reflection
+// rather than handed to encoding/json as a whole.
+func (o MarshalOptions) needsReflect(t reflect.Type) bool {
+	return containsMessage(t) || containsTimeMap(t) || containsInterface(t) ||
+		o.Int64AsString && containsInt64(t) ||
+		o.NilSliceAsEmptyArray && containsSlice(t)
+}
+
+// marshalReflectValue marshals the Go value rv. It follows encoding/json,
+// except for proto messages, which go through the proto encoder, for maps of
+// time.Time values, see marshalReflectMap, for integers of kind int64 and
+// uint64, which are quoted under Int64AsString, and for nil slices, which are
+// written as [] under NilSliceAsEmptyArray.
+func (e encoder) marshalReflectValue(rv reflect.Value) error {
+	if rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		e.WriteNull()
+		return nil
+	}
+	t := rv.Type()
+	if t.Implements(messageType) {
+		return e.marshalReflectMessage(rv.Interface().(proto.Message))
+	}
+	if !e.snakeCase && !e.opts.needsReflect(t) || hasJSONMethods(t) {
+		b, err := stdjson.Marshal(rv.Interface())
+		if err != nil {
+			return err
+		}
+		return e.WriteRawValue(b)
+	}
+
+	switch t.Kind() {
+	case reflect.Int64:
+		return e.WriteString(strconv.FormatInt(rv.Int(), 10))
+
+	case reflect.Uint64:
+		return e.WriteString(strconv.FormatUint(rv.Uint(), 10))
+
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			e.WriteNull()
+			return nil
+		}
+		return e.marshalReflectValue(rv.Elem())
+
+	case reflect.Struct:
+		return e.marshalReflectStruct(rv)
+
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && rv.IsNil() && !e.opts.NilSliceAsEmptyArray {
+			e.WriteNull()
+			return nil
+		}
+		e.StartArray()
+		defer e.EndArray()
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.marshalReflectValue(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		return e.marshalReflectMap(rv)
+	}
+
+	b, err := stdjson.Marshal(rv.Interface())
+	if err != nil {
+		return err
+	}
+	return e.WriteRawValue(b)
+}
+
+// marshalReflectStruct marshals a Go struct as a JSON object, naming the
+// fields as encoding/json does. Structs holding proto messages are envelopes
+// around them, so that their untagged fields are given lowerCamelCase names
+// like proto fields.
+func (e encoder) marshalReflectStruct(rv reflect.Value) error {
+	e.StartObject()
+	defer e.EndObject()
+
+	camelCase := containsMessage(rv.Type())
+	for _, f := range structFields(rv.Type()) {
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		name := f.name
+		if camelCase && !f.tagged {
+			name = lowerCamelCase(name)
+		}
+		if err := e.WriteName(e.memberName(name)); err != nil {
+			return err
+		}
+		if f.quoted {
+			if err := e.marshalQuoted(fv); err != nil {
+				return err
+			}
+			continue
+		}
+		fe := e
+		fe.snakeCase = false
+		if err := fe.marshalReflectValue(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalQuoted marshals the value rv of a field with the string option as
+// encoding/json does: its JSON encoding, within a JSON string. Int64AsString
+// does not quote it again.
+func (e encoder) marshalQuoted(rv reflect.Value) error {
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			e.WriteNull()
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	b, err := stdjson.Marshal(rv.Interface())
+	if err != nil {
+		return err
+	}
+	return e.WriteString(string(b))
+}
+
+// marshalReflectMap marshals a Go map as a JSON object with sorted keys, which
+// are named as by encoding/json. Keys of maps of messages follow the
+// CamelCaseMapKeys and DualMapKeys options. The time.Time values of a map are
+// written like a google.protobuf.Timestamp, in UTC, rather than as by
+// encoding/json; they are not points in time for TimestampsRelativeTo,
+// however. Maps with keys that encoding/json does not support are left to it
+// to report.
+func (e encoder) marshalReflectMap(rv reflect.Value) error {
+	if rv.IsNil() {
+		e.WriteNull()
+		return nil
+	}
+	if !isMapKeyType(rv.Type().Key()) {
+		b, err := stdjson.Marshal(rv.Interface())
+		if err != nil {
+			return err
+		}
+		return e.WriteRawValue(b)
+	}
+
+	type mapKey struct {
+		value reflect.Value
+		name  string
+	}
+	keys := make([]mapKey, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		name, err := mapKeyName(k)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, mapKey{value: k, name: name})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+	dual := e.opts.DualMapKeys && isMessageMap(rv.Type())
+	camelCase := e.opts.CamelCaseMapKeys && isMessageMap(rv.Type()) && !dual
+	// aliases holds the lowerCamelCase keys written with DualMapKeys.
+	var aliases map[string]bool
+	if dual {
+		aliases = map[string]bool{}
+	}
+	times := isTimeMap(rv.Type())
+	if times {
+		e.opts.TimestampsRelativeTo = time.Time{}
+	}
+
+	e.StartObject()
+	defer e.EndObject()
+
+	for _, key := range keys {
+		k := key.value
+		names := []string{key.name}
+		if camelCase {
+			names[0] = JSONCamelCase(names[0])
+		}
+		if alias := JSONCamelCase(key.name); dual && alias != key.name && !aliases[alias] && !rv.MapIndex(reflect.ValueOf(alias).Convert(k.Type())).IsValid() {
+			aliases[alias] = true
+			names = append(names, alias)
+		}
+		for _, name := range names {
+			if err := e.WriteName(name); err != nil {
+				return err
+			}
+			if times {
+				tm := rv.MapIndex(k).Interface().(time.Time)
+				if err := e.writeTimestamp(tm.Unix(), int64(tm.Nanosecond())); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := e.marshalReflectValue(rv.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isMapKeyType reports whether encoding/json accepts map keys of type t.
+func isMapKeyType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return t.Implements(textMarshalerType)
+}
+
+// mapKeyName returns the name of the map key k as a JSON object member, as
+// chosen by encoding/json: strings are used as is, then keys marshaling
+// themselves as text are, and integers are written in decimal.
+func mapKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	}
+	return strconv.FormatUint(k.Uint(), 10), nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, except that it reports
+// false instead of panicking on a nil pointer to an embedded struct.
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+// isEmptyValue reports whether rv is empty in the sense of the omitempty
+// option of encoding/json.
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// marshalReflectMessage marshals a proto message found inside a Go value.
+// A nil message is written as null.
+func (e encoder) marshalReflectMessage(m proto.Message) error {
+	if rv := reflect.ValueOf(m); !rv.IsValid() || rv.Kind() == reflect.Ptr && rv.IsNil() {
+		e.WriteNull()
+		return nil
+	}
+	if err := e.marshalMessage(m.ProtoReflect(), ""); err != nil {
+		return err
+	}
+	if e.opts.AllowPartial {
+		return nil
+	}
+	return proto.CheckInitialized(m)
+}
+
+// unmarshalReflect reads the JSON document b into v, which is not a
+// proto.Message. Messages held by struct fields, pointers, slices and maps are
+// allocated as needed and read with the proto decoder; everything else is left
+// to encoding/json. Like encoding/json, null and absent values leave the
+// destination untouched, except that pointers are set to nil by null.
+func (o UnmarshalOptions) unmarshalReflect(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || !containsMessage(rv.Type().Elem()) {
+		return stdjson.Unmarshal(b, v)
+	}
+	return o.unmarshalValue(b, rv.Elem())
+}
+
+// unmarshalQuoted reads the JSON value b of a field with the string option
+// into the addressable value rv, as encoding/json does: b holds the JSON
+// encoding of the value within a JSON string, or is null.
+func unmarshalQuoted(b []byte, rv reflect.Value) error {
+	if bytes.Equal(bytes.TrimSpace(b), []byte("null")) {
+		if rv.Kind() == reflect.Ptr {
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	}
+	var s string
+	if err := stdjson.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return stdjson.Unmarshal([]byte(s), rv.Addr().Interface())
+}
+
+// unmarshalValue reads the JSON value b into the addressable value rv.
+func (o UnmarshalOptions) unmarshalValue(b []byte, rv reflect.Value) error {
+	t := rv.Type()
+	if !containsMessage(t) {
+		return stdjson.Unmarshal(b, rv.Addr().Interface())
+	}
+	if bytes.Equal(bytes.TrimSpace(b), []byte("null")) {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			rv.Set(reflect.Zero(t))
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return errors.New("cannot unmarshal into nil %v", t)
+		}
+		m := rv.Interface().(proto.Message)
+		return o.Unmarshal(b, m)
+
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(t.Elem()))
+		}
+		if t.Implements(messageType) {
+			return o.Unmarshal(b, rv.Interface().(proto.Message))
+		}
+		return o.unmarshalValue(b, rv.Elem())
+
+	case reflect.Struct:
+		var obj map[string]stdjson.RawMessage
+		if err := stdjson.Unmarshal(b, &obj); err != nil {
+			return err
+		}
+		for _, f := range structFields(t) {
+			raw, ok := obj[f.name]
+			if !ok {
+				raw, ok = lookupFold(obj, f.name)
+			}
+			if !ok {
+				continue
+			}
+			fv, err := fieldByIndexAlloc(rv, f.index)
+			if err != nil {
+				return err
+			}
+			if f.quoted {
+				err = unmarshalQuoted(raw, fv)
+			} else {
+				err = o.unmarshalValue(raw, fv)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice, reflect.Array:
+		var list []stdjson.RawMessage
+		if err := stdjson.Unmarshal(b, &list); err != nil {
+			return err
+		}
+		if t.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(t, len(list), len(list)))
+		}
+		for i := 0; i < len(list) && i < rv.Len(); i++ {
+			if err := o.unmarshalValue(list[i], rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return errors.New("cannot unmarshal into %v: map keys must be strings", t)
+		}
+		var obj map[string]stdjson.RawMessage
+		if err := stdjson.Unmarshal(b, &obj); err != nil {
+			return err
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(t, len(obj)))
+		}
+		for k, raw := range obj {
+			elem := reflect.New(t.Elem()).Elem()
+			if err := o.unmarshalValue(raw, elem); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), elem)
+		}
+		return nil
+	}
+	return stdjson.Unmarshal(b, rv.Addr().Interface())
+}
+
+// lookupFold finds the entry of obj whose key matches name case-insensitively,
+// which is how encoding/json matches keys to struct fields.
+func lookupFold(obj map[string]stdjson.RawMessage, name string) (stdjson.RawMessage, bool) {
+	for k, raw := range obj {
+		if strings.EqualFold(k, name) {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// fieldByIndexAlloc is like reflect.Value.FieldByIndex, except that it
+// allocates nil pointers to embedded structs along the way.
+func fieldByIndexAlloc(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, errors.New("cannot set embedded pointer to unexported struct %v", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
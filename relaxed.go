@@ -0,0 +1,157 @@
+package jsonpb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"jsonpb/errors"
+)
+
+// relaxJSON rewrites the relaxed JSON document b, as accepted with
+// UnmarshalOptions.RelaxedJSON, into standard JSON: unquoted object keys are
+// quoted, and single-quoted strings are turned into double-quoted ones.
+// Anything else is copied as is, for the JSON parser to validate. Standard
+// JSON is returned unchanged.
+func relaxJSON(b []byte) ([]byte, error) {
+	return io.ReadAll(newRelaxedReader(bytes.NewReader(b)))
+}
+
+// relaxedReader reads relaxed JSON from r as standard JSON, like relaxJSON,
+// so that a stream of values can be decoded without reading it in full.
+type relaxedReader struct {
+	r *bufio.Reader
+
+	// out holds the rewritten input that is yet to be read.
+	out []byte
+
+	// err is the error to return once out is drained.
+	err error
+}
+
+func newRelaxedReader(r io.Reader) *relaxedReader {
+	return &relaxedReader{r: bufio.NewReader(r)}
+}
+
+func (r *relaxedReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		r.err = r.next()
+	}
+	if len(r.out) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next rewrites the next token of the input, or the next byte if it does not
+// start a string or an identifier, into out.
+func (r *relaxedReader) next() error {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == '"' || c == '\'':
+		s, err := r.readString(c)
+		if err != nil {
+			return err
+		}
+		if c == '"' {
+			r.out = append(append(append(r.out, '"'), s...), '"')
+		} else {
+			r.out = appendSingleQuoted(r.out, s)
+		}
+
+	case isIdentStart(c):
+		ident := []byte{c}
+		for {
+			b, err := r.r.Peek(1)
+			if err != nil || !isIdentPart(b[0]) {
+				break
+			}
+			ident = append(ident, b[0])
+			r.r.Discard(1)
+		}
+		// Look past any whitespace for the colon ending an object key.
+		var space []byte
+		for {
+			b, err := r.r.Peek(1)
+			if err != nil || !isJSONSpace(b[0]) {
+				if err == nil && b[0] == ':' {
+					ident = append(append([]byte{'"'}, ident...), '"')
+				}
+				break
+			}
+			space = append(space, b[0])
+			r.r.Discard(1)
+		}
+		r.out = append(append(r.out, ident...), space...)
+
+	default:
+		r.out = append(r.out, c)
+	}
+	return nil
+}
+
+// readString returns the contents of the string quoted by q, whose opening
+// quote is already read, consuming the closing quote.
+func (r *relaxedReader) readString(q byte) ([]byte, error) {
+	var s []byte
+	for {
+		c, err := r.r.ReadByte()
+		if err == io.EOF {
+			return nil, errors.New("invalid relaxed JSON: unterminated string")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case q:
+			return s, nil
+		case '\\':
+			s = append(s, c)
+			if c, err = r.r.ReadByte(); err == io.EOF {
+				return nil, errors.New("invalid relaxed JSON: unterminated string")
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		s = append(s, c)
+	}
+}
+
+// appendSingleQuoted appends the contents s of a single-quoted string to out
+// as a double-quoted one.
+func appendSingleQuoted(out, s []byte) []byte {
+	out = append(out, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			out = append(out, '\\', '"')
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\'':
+			out = append(out, '\'')
+			i++
+		case c == '\\' && i+1 < len(s):
+			out = append(out, c, s[i+1])
+			i++
+		default:
+			out = append(out, c)
+		}
+	}
+	return append(out, '"')
+}
+
+// isJSONSpace reports whether c is whitespace in JSON.
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isIdentStart(c byte) bool {
+	return isASCIILower(c) || isASCIIUpper(c) || c == '_' || c == '$'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isASCIIDigit(c)
+}
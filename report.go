@@ -0,0 +1,26 @@
+package jsonpb
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// WKTReport counts the well-known types, such as google.protobuf.Any or
+// google.protobuf.Timestamp, by full name.
+type WKTReport map[protoreflect.FullName]int
+
+// MarshalReport marshals m like Marshal, discarding the output, and reports
+// how many times each well-known type with a specialized JSON representation
+// was encountered. It is meant for schema analysis tooling. A top-level
+// well-known message counts as well, as do messages embedded in an Any.
+func (o MarshalOptions) MarshalReport(m proto.Message) (WKTReport, error) {
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+	report := WKTReport{}
+	if _, err := o.marshal(nil, m, nil, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,65 @@
+package jsonpb
+
+import (
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// ResolverChain is a type resolver that tries each of its resolvers in turn,
+// so that a local registry can supplement or override protoregistry.GlobalTypes.
+// It can be used as the Resolver of both MarshalOptions and UnmarshalOptions.
+// Extensions are looked up in the resolvers that also implement
+// protoregistry.ExtensionTypeResolver.
+type ResolverChain []protoregistry.MessageTypeResolver
+
+// FindMessageByName returns the first message type named message found in
+// the chain.
+func (c ResolverChain) FindMessageByName(message protoreflect.FullName) (protoreflect.MessageType, error) {
+	for _, r := range c {
+		mt, err := r.FindMessageByName(message)
+		if err != protoregistry.NotFound {
+			return mt, err
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindMessageByURL returns the first message type for the type URL url found
+// in the chain.
+func (c ResolverChain) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	for _, r := range c {
+		mt, err := r.FindMessageByURL(url)
+		if err != protoregistry.NotFound {
+			return mt, err
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByName returns the first extension type named field found in
+// the chain.
+func (c ResolverChain) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	for _, r := range c {
+		if r, ok := r.(protoregistry.ExtensionTypeResolver); ok {
+			xt, err := r.FindExtensionByName(field)
+			if err != protoregistry.NotFound {
+				return xt, err
+			}
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByNumber returns the first extension type of the message
+// message with the field number field found in the chain.
+func (c ResolverChain) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	for _, r := range c {
+		if r, ok := r.(protoregistry.ExtensionTypeResolver); ok {
+			xt, err := r.FindExtensionByNumber(message, field)
+			if err != protoregistry.NotFound {
+				return xt, err
+			}
+		}
+	}
+	return nil, protoregistry.NotFound
+}
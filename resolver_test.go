@@ -0,0 +1,54 @@
+package jsonpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const testChainProtoFile = `
+name: "jsonpb/chain.proto"
+package: "jsonpb.test.chain"
+syntax: "proto3"
+message_type {
+  name: "Gadget"
+  field { name: "serial" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+`
+
+func TestResolverChain(t *testing.T) {
+	local := new(protoregistry.Types)
+	fd := registerTestFile(testChainProtoFile, new(protoregistry.Files), local)
+	gadget := dynamicpb.NewMessage(fd.Messages().ByName("Gadget"))
+	require.NoError(t, protojson.Unmarshal([]byte(`{"serial":"s1"}`), gadget))
+	extra, err := anypb.New(gadget)
+	require.NoError(t, err)
+	m := sampleType.New()
+	m.Set(m.Descriptor().Fields().ByName("extra"), protoreflect.ValueOfMessage(extra.ProtoReflect()))
+
+	// The global registry misses the Gadget, the local one resolves it; the
+	// Sample itself comes from the global one.
+	chain := ResolverChain{protoregistry.GlobalTypes, local}
+	actual, err := MarshalOptions{Resolver: chain}.Marshal(m.Interface())
+	require.NoError(t, err)
+	require.Equal(t, `{"extra":{"@type":"type.googleapis.com/jsonpb.test.chain.Gadget","serial":"s1"}}`, string(actual))
+
+	got := sampleType.New().Interface()
+	require.NoError(t, UnmarshalOptions{Resolver: chain}.Unmarshal(actual, got))
+	again, err := MarshalOptions{Resolver: chain}.Marshal(got)
+	require.NoError(t, err)
+	require.Equal(t, string(actual), string(again))
+
+	_, err = chain.FindMessageByName("jsonpb.test.chain.Missing")
+	require.Equal(t, protoregistry.NotFound, err)
+	_, err = ResolverChain{local}.FindExtensionByName("jsonpb.test.chain.ext")
+	require.Equal(t, protoregistry.NotFound, err)
+
+	_, err = MarshalOptions{Resolver: ResolverChain{protoregistry.GlobalTypes}}.Marshal(m.Interface())
+	require.Error(t, err)
+}
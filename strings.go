@@ -80,6 +80,25 @@ func JSONSnakeCase(s string) string {
 	return string(b)
 }
 
+// lowerCamelCase converts an exported Go identifier to lowerCamelCase by
+// lowering its leading run of upper case letters, except for the last one if
+// it starts the next word, e.g. "ManagerId" to "managerId" and "URLPath" to
+// "urlPath".
+func lowerCamelCase(s string) string {
+	n := 0
+	for n < len(s) && isASCIIUpper(s[n]) {
+		n++
+	}
+	if n > 1 && n < len(s) && isASCIILower(s[n]) {
+		n--
+	}
+	b := []byte(s)
+	for i := 0; i < n; i++ {
+		b[i] += 'a' - 'A' // convert to lowercase
+	}
+	return string(b)
+}
+
 func isASCIILower(c byte) bool {
 	return 'a' <= c && c <= 'z'
 }
@@ -0,0 +1,133 @@
+package jsonpb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/fieldmaskpb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testProtoFile describes the messages used throughout the tests. There is no
+// protoc in the build, so the schema is registered dynamically.
+const testProtoFile = `
+name: "jsonpb/test.proto"
+package: "jsonpb.test"
+syntax: "proto3"
+dependency: "google/protobuf/any.proto"
+dependency: "google/protobuf/duration.proto"
+dependency: "google/protobuf/field_mask.proto"
+dependency: "google/protobuf/struct.proto"
+dependency: "google/protobuf/timestamp.proto"
+dependency: "google/protobuf/wrappers.proto"
+enum_type {
+  name: "Color"
+  value { name: "COLOR_UNSPECIFIED" number: 0 }
+  value { name: "RED" number: 1 }
+  value { name: "GREEN" number: 2 }
+}
+message_type {
+  name: "Nested"
+  field { name: "name" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "count" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+  field { name: "child" number: 3 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".jsonpb.test.Nested" }
+}
+message_type {
+  name: "Sample"
+  field { name: "id" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "manager_id" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+  field { name: "big" number: 3 label: LABEL_OPTIONAL type: TYPE_UINT64 }
+  field { name: "small" number: 4 label: LABEL_OPTIONAL type: TYPE_INT32 }
+  field { name: "flag" number: 5 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field { name: "ratio" number: 6 label: LABEL_OPTIONAL type: TYPE_DOUBLE }
+  field { name: "score" number: 7 label: LABEL_OPTIONAL type: TYPE_FLOAT }
+  field { name: "data" number: 8 label: LABEL_OPTIONAL type: TYPE_BYTES }
+  field { name: "color" number: 9 label: LABEL_OPTIONAL type: TYPE_ENUM type_name: ".jsonpb.test.Color" }
+  field { name: "tags" number: 10 label: LABEL_REPEATED type: TYPE_STRING }
+  field { name: "values" number: 11 label: LABEL_REPEATED type: TYPE_DOUBLE }
+  field { name: "counts" number: 12 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".jsonpb.test.Sample.CountsEntry" }
+  field { name: "nested" number: 13 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".jsonpb.test.Nested" }
+  field { name: "children" number: 14 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".jsonpb.test.Nested" }
+  field { name: "text" number: 15 label: LABEL_OPTIONAL type: TYPE_STRING oneof_index: 0 }
+  field { name: "number" number: 16 label: LABEL_OPTIONAL type: TYPE_INT64 oneof_index: 0 }
+  field { name: "created_at" number: 17 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Timestamp" }
+  field { name: "ttl" number: 18 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Duration" }
+  field { name: "alias" number: 19 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.StringValue" }
+  field { name: "extra" number: 20 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Any" }
+  field { name: "attrs" number: 21 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.Struct" }
+  field { name: "nickname" number: 22 label: LABEL_OPTIONAL type: TYPE_STRING oneof_index: 1 proto3_optional: true }
+  field { name: "mask" number: 23 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.FieldMask" }
+  field { name: "labels" number: 24 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".jsonpb.test.Sample.LabelsEntry" }
+  field { name: "colors" number: 25 label: LABEL_REPEATED type: TYPE_ENUM type_name: ".jsonpb.test.Color" }
+  field { name: "enabled" number: 26 label: LABEL_OPTIONAL type: TYPE_MESSAGE type_name: ".google.protobuf.BoolValue" }
+  nested_type {
+    name: "CountsEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_INT64 }
+    options { map_entry: true }
+  }
+  nested_type {
+    name: "LabelsEntry"
+    field { name: "key" number: 1 label: LABEL_OPTIONAL type: TYPE_INT64 }
+    field { name: "value" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+    options { map_entry: true }
+  }
+  oneof_decl { name: "choice" }
+  oneof_decl { name: "_nickname" }
+}
+`
+
+var (
+	nestedType protoreflect.MessageType
+	sampleType protoreflect.MessageType
+)
+
+func init() {
+	fd := registerTestFile(testProtoFile, protoregistry.GlobalFiles, protoregistry.GlobalTypes)
+	nestedType = dynamicpb.NewMessageType(fd.Messages().ByName("Nested"))
+	sampleType = dynamicpb.NewMessageType(fd.Messages().ByName("Sample"))
+}
+
+// registerTestFile builds the file descriptor described by the text-format
+// src and registers it, along with its message types, in files and types.
+func registerTestFile(src string, files *protoregistry.Files, types *protoregistry.Types) protoreflect.FileDescriptor {
+	fdp := new(descriptorpb.FileDescriptorProto)
+	if err := prototext.Unmarshal([]byte(src), fdp); err != nil {
+		panic(err)
+	}
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	if err := files.RegisterFile(fd); err != nil {
+		panic(err)
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		if err := types.RegisterMessage(dynamicpb.NewMessageType(fd.Messages().Get(i))); err != nil {
+			panic(err)
+		}
+	}
+	return fd
+}
+
+// newMessage returns a new message of type mt populated from the JSON src
+// by the upstream protojson decoder.
+func newMessage(t testing.TB, mt protoreflect.MessageType, src string) proto.Message {
+	t.Helper()
+	m := mt.New().Interface()
+	require.NoError(t, protojson.Unmarshal([]byte(src), m))
+	return m
+}
@@ -5,6 +5,7 @@
 package jsonpb
 
 import (
+	"encoding/base64"
 	"fmt"
 	"math"
 	"strings"
@@ -55,6 +56,43 @@ func wellKnownTypeMarshaler(name protoreflect.FullName) marshalFunc {
 	return nil
 }
 
+// wellKnownTypeMarshaler is like the package function of the same name, but
+// also counts the returned marshaler in the report of e, if any.
+func (e encoder) wellKnownTypeMarshaler(name protoreflect.FullName) marshalFunc {
+	marshal := wellKnownTypeMarshaler(name)
+	if marshal != nil && e.report != nil {
+		e.report[name]++
+	}
+	return marshal
+}
+
+// isWrapperType reports whether the named message type is one of the wrapper
+// types, such as google.protobuf.StringValue.
+func isWrapperType(name protoreflect.FullName) bool {
+	if name.Parent() != genid.GoogleProtobuf_package {
+		return false
+	}
+	switch name.Name() {
+	case genid.BoolValue_message_name,
+		genid.Int32Value_message_name,
+		genid.Int64Value_message_name,
+		genid.UInt32Value_message_name,
+		genid.UInt64Value_message_name,
+		genid.FloatValue_message_name,
+		genid.DoubleValue_message_name,
+		genid.StringValue_message_name,
+		genid.BytesValue_message_name:
+		return true
+	}
+	return false
+}
+
+// isWellKnown reports whether the named message type has a specialized JSON
+// representation.
+func isWellKnown(name protoreflect.FullName) bool {
+	return wellKnownTypeMarshaler(name) != nil
+}
+
 // The JSON representation of an Any message uses the regular representation of
 // the deserialized, embedded message, with an additional field `@type` which
 // contains the type URL. If the embedded message type is well-known and has a
@@ -72,35 +110,29 @@ func (e encoder) marshalAny(m protoreflect.Message) error {
 			e.StartObject()
 			e.EndObject()
 			return nil
+		} else if key := e.opts.UntypedAnyKey; key != "" {
+			// Marshal out the raw value, as the type to expand it with is unknown.
+			e.StartObject()
+			defer e.EndObject()
+			if err := e.WriteName(key); err != nil {
+				return err
+			}
+			return e.WriteString(base64.StdEncoding.EncodeToString(m.Get(fdValue).Bytes()))
 		} else {
 			// Return error if type_url field is not set, but value is set.
 			return errors.New("%s: %v is not set", genid.Any_message_fullname, genid.Any_TypeUrl_field_name)
 		}
 	}
 
-	typeVal := m.Get(fdType)
-	valueVal := m.Get(fdValue)
-
-	// Resolve the type in order to unmarshal value field.
-	typeURL := typeVal.String()
-	emt, err := e.opts.Resolver.FindMessageByURL(typeURL)
-	if err != nil {
-		return errors.New("%s: unable to resolve %q: %v", genid.Any_message_fullname, typeURL, err)
-	}
-
-	em := emt.New()
-	err = proto.UnmarshalOptions{
-		AllowPartial: true, // never check required fields inside an Any
-		Resolver:     e.opts.Resolver,
-	}.Unmarshal(valueVal.Bytes(), em.Interface())
+	typeURL, em, err := e.unpackAny(m)
 	if err != nil {
-		return errors.New("%s: unable to unmarshal %q: %v", genid.Any_message_fullname, typeURL, err)
+		return err
 	}
 
 	// If type of value has custom JSON encoding, marshal out a field "value"
 	// with corresponding custom JSON encoding of the embedded message as a
 	// field.
-	if marshal := wellKnownTypeMarshaler(emt.Descriptor().FullName()); marshal != nil {
+	if marshal := e.wellKnownTypeMarshaler(em.Descriptor().FullName()); marshal != nil {
 		e.StartObject()
 		defer e.EndObject()
 
@@ -109,6 +141,12 @@ func (e encoder) marshalAny(m protoreflect.Message) error {
 		if err := e.WriteString(typeURL); err != nil {
 			return err
 		}
+		if err := e.writeAnyDiscriminator(em.Descriptor()); err != nil {
+			return err
+		}
+		if e.tooManyFields(e.anyHeaderLen() + 1) {
+			return e.maxFieldsError(m.Descriptor())
+		}
 
 		e.WriteName("value")
 		return marshal(e, em)
@@ -122,6 +160,31 @@ func (e encoder) marshalAny(m protoreflect.Message) error {
 	return nil
 }
 
+// unpackAny returns the type URL of the Any m, which must be set, along with
+// the message it embeds.
+func (e encoder) unpackAny(m protoreflect.Message) (string, protoreflect.Message, error) {
+	fds := m.Descriptor().Fields()
+	typeVal := m.Get(fds.ByNumber(genid.Any_TypeUrl_field_number))
+	valueVal := m.Get(fds.ByNumber(genid.Any_Value_field_number))
+
+	// Resolve the type in order to unmarshal value field.
+	typeURL := typeVal.String()
+	emt, err := e.opts.Resolver.FindMessageByURL(typeURL)
+	if err != nil {
+		return "", nil, errors.New("%s: unable to resolve %q: %v", genid.Any_message_fullname, typeURL, err)
+	}
+
+	em := emt.New()
+	err = proto.UnmarshalOptions{
+		AllowPartial: true, // never check required fields inside an Any
+		Resolver:     e.opts.Resolver,
+	}.Unmarshal(valueVal.Bytes(), em.Interface())
+	if err != nil {
+		return "", nil, errors.New("%s: unable to unmarshal %q: %v", genid.Any_message_fullname, typeURL, err)
+	}
+	return typeURL, em, nil
+}
+
 // Wrapper types are encoded as JSON primitives like string, number or boolean.
 
 func (e encoder) marshalWrapperType(m protoreflect.Message) error {
@@ -163,10 +226,18 @@ func (e encoder) marshalKnownValue(m protoreflect.Message) error {
 	od := m.Descriptor().Oneofs().ByName(genid.Value_Kind_oneof_name)
 	fd := m.WhichOneof(od)
 	if fd == nil {
+		if e.opts.InvalidValuesAsNull {
+			e.WriteNull()
+			return nil
+		}
 		return errors.New("%s: none of the oneof fields is set", genid.Value_message_fullname)
 	}
 	if fd.Number() == genid.Value_NumberValue_field_number {
 		if v := m.Get(fd).Float(); math.IsNaN(v) || math.IsInf(v, 0) {
+			if e.opts.InvalidValuesAsNull {
+				e.WriteNull()
+				return nil
+			}
 			return errors.New("%s: invalid %v value", genid.Value_NumberValue_field_fullname, v)
 		}
 	}
@@ -197,8 +268,12 @@ func (e encoder) marshalDuration(m protoreflect.Message) error {
 
 	secsVal := m.Get(fdSeconds)
 	nanosVal := m.Get(fdNanos)
-	secs := secsVal.Int()
-	nanos := nanosVal.Int()
+	return e.writeDuration(secsVal.Int(), nanosVal.Int())
+}
+
+// writeDuration writes out the span given in seconds and nanoseconds in the
+// JSON representation of a Duration.
+func (e encoder) writeDuration(secs, nanos int64) error {
 	if secs < -maxSecondsInDuration || secs > maxSecondsInDuration {
 		return errors.New("%s: seconds out of range %v", genid.Duration_message_fullname, secs)
 	}
@@ -214,10 +289,18 @@ func (e encoder) marshalDuration(m protoreflect.Message) error {
 	if secs < 0 || nanos < 0 {
 		sign, secs, nanos = "-", -1*secs, -1*nanos
 	}
+	n := e.opts.DurationFractionDigits
+	if n != nil && *n == 0 && secs == 0 {
+		sign = "" // truncated to zero
+	}
 	x := fmt.Sprintf("%s%d.%09d", sign, secs, nanos)
-	x = strings.TrimSuffix(x, "000")
-	x = strings.TrimSuffix(x, "000")
-	x = strings.TrimSuffix(x, ".000")
+	if n != nil {
+		x = strings.TrimSuffix(x[:len(x)-9+*n], ".")
+	} else {
+		x = strings.TrimSuffix(x, "000")
+		x = strings.TrimSuffix(x, "000")
+		x = strings.TrimSuffix(x, ".000")
+	}
 	e.WriteString(x + "s")
 	return nil
 }
@@ -247,21 +330,40 @@ func (e encoder) marshalTimestamp(m protoreflect.Message) error {
 
 	secsVal := m.Get(fdSeconds)
 	nanosVal := m.Get(fdNanos)
-	secs := secsVal.Int()
-	nanos := nanosVal.Int()
+	return e.writeTimestamp(secsVal.Int(), nanosVal.Int())
+}
+
+// writeTimestamp writes out the instant given in seconds and nanoseconds since
+// the Unix epoch in the JSON representation of a Timestamp.
+func (e encoder) writeTimestamp(secs, nanos int64) error {
 	if secs < minTimestampSeconds || secs > maxTimestampSeconds {
 		return errors.New("%s: seconds out of range %v", genid.Timestamp_message_fullname, secs)
 	}
 	if nanos < 0 || nanos > secondsInNanos {
 		return errors.New("%s: nanos out of range %v", genid.Timestamp_message_fullname, nanos)
 	}
+	if ref := e.opts.TimestampsRelativeTo; !ref.IsZero() {
+		// Written as the Duration since ref, with the signs of seconds and
+		// nanos made to agree.
+		secs, nanos = secs-ref.Unix(), nanos-int64(ref.Nanosecond())
+		if secs > 0 && nanos < 0 {
+			secs, nanos = secs-1, nanos+1e9
+		} else if secs < 0 && nanos > 0 {
+			secs, nanos = secs+1, nanos-1e9
+		}
+		return e.writeDuration(secs, nanos)
+	}
 	// Uses RFC 3339, where generated output will be Z-normalized and uses 0, 3,
 	// 6 or 9 fractional digits.
 	t := time.Unix(secs, nanos).UTC()
 	x := t.Format("2006-01-02T15:04:05.000000000")
-	x = strings.TrimSuffix(x, "000")
-	x = strings.TrimSuffix(x, "000")
-	x = strings.TrimSuffix(x, ".000")
+	if n := e.opts.TimestampFractionDigits; n != nil {
+		x = strings.TrimSuffix(x[:len(x)-9+*n], ".")
+	} else {
+		x = strings.TrimSuffix(x, "000")
+		x = strings.TrimSuffix(x, "000")
+		x = strings.TrimSuffix(x, ".000")
+	}
 	e.WriteString(x + "Z")
 	return nil
 }
@@ -289,6 +391,14 @@ func (e encoder) marshalFieldMask(m protoreflect.Message) error {
 		paths = append(paths, cc)
 	}
 
+	if e.opts.FieldMaskAsArray {
+		e.StartArray()
+		defer e.EndArray()
+		for _, p := range paths {
+			e.WriteString(p)
+		}
+		return nil
+	}
 	e.WriteString(strings.Join(paths, ","))
 	return nil
 }
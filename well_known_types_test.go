@@ -0,0 +1,136 @@
+package jsonpb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTimestampFractionDigits(t *testing.T) {
+	ts := timestamppb.New(time.Date(2023, 8, 29, 0, 0, 0, 120000000, time.UTC))
+	whole := timestamppb.New(time.Date(2023, 8, 29, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		digits    *int
+		want      string
+		wantWhole string
+	}{
+		{nil, `"2023-08-29T00:00:00.120Z"`, `"2023-08-29T00:00:00Z"`},
+		{FractionDigits(0), `"2023-08-29T00:00:00Z"`, `"2023-08-29T00:00:00Z"`},
+		{FractionDigits(3), `"2023-08-29T00:00:00.120Z"`, `"2023-08-29T00:00:00.000Z"`},
+		{FractionDigits(6), `"2023-08-29T00:00:00.120000Z"`, `"2023-08-29T00:00:00.000000Z"`},
+		{FractionDigits(9), `"2023-08-29T00:00:00.120000000Z"`, `"2023-08-29T00:00:00.000000000Z"`},
+	}
+	for _, tt := range tests {
+		opts := MarshalOptions{TimestampFractionDigits: tt.digits}
+		actual, err := opts.Marshal(ts)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(actual), tt.want)
+
+		actual, err = opts.Marshal(whole)
+		require.NoError(t, err)
+		require.Equal(t, tt.wantWhole, string(actual), tt.want)
+	}
+
+	// Precision beyond the requested digits is truncated.
+	fine := timestamppb.New(time.Date(2023, 8, 29, 0, 0, 0, 123456789, time.UTC))
+	actual, err := MarshalOptions{TimestampFractionDigits: FractionDigits(3)}.Marshal(fine)
+	require.NoError(t, err)
+	require.Equal(t, `"2023-08-29T00:00:00.123Z"`, string(actual))
+}
+
+func TestTimestampFractionDigitsInvalid(t *testing.T) {
+	for _, digits := range []int{-1, 1, 2, 4, 10} {
+		_, err := NewEncoder(MarshalOptions{TimestampFractionDigits: FractionDigits(digits)})
+		require.Error(t, err, digits)
+	}
+}
+
+func TestDurationFractionDigits(t *testing.T) {
+	m := newMessage(t, sampleType, `{"createdAt":"2023-08-29T00:00:00.120Z","ttl":"-1.500s"}`)
+	tests := []struct {
+		timestampDigits, durationDigits *int
+		want                            string
+	}{
+		{nil, nil, `{"createdAt":"2023-08-29T00:00:00.120Z","ttl":"-1.500s"}`},
+		{nil, FractionDigits(9), `{"createdAt":"2023-08-29T00:00:00.120Z","ttl":"-1.500000000s"}`},
+		{nil, FractionDigits(0), `{"createdAt":"2023-08-29T00:00:00.120Z","ttl":"-1s"}`},
+		{FractionDigits(9), nil, `{"createdAt":"2023-08-29T00:00:00.120000000Z","ttl":"-1.500s"}`},
+		{FractionDigits(0), FractionDigits(3), `{"createdAt":"2023-08-29T00:00:00Z","ttl":"-1.500s"}`},
+		{FractionDigits(3), FractionDigits(6), `{"createdAt":"2023-08-29T00:00:00.120Z","ttl":"-1.500000s"}`},
+		{FractionDigits(6), FractionDigits(3), `{"createdAt":"2023-08-29T00:00:00.120000Z","ttl":"-1.500s"}`},
+	}
+	for _, tt := range tests {
+		actual, err := MarshalOptions{TimestampFractionDigits: tt.timestampDigits, DurationFractionDigits: tt.durationDigits}.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(actual))
+	}
+
+	// Precision beyond the requested digits is truncated, whole seconds keep
+	// the fixed digits.
+	for _, tt := range []struct {
+		digits int
+		d      *durationpb.Duration
+		want   string
+	}{
+		{3, &durationpb.Duration{Seconds: 1, Nanos: 123456789}, `"1.123s"`},
+		{3, &durationpb.Duration{Seconds: -2}, `"-2.000s"`},
+		{3, &durationpb.Duration{Nanos: -1000000}, `"-0.001s"`},
+		{0, &durationpb.Duration{Seconds: 1, Nanos: 999999999}, `"1s"`},
+		{0, &durationpb.Duration{Nanos: -1000000}, `"0s"`},
+	} {
+		actual, err := MarshalOptions{DurationFractionDigits: FractionDigits(tt.digits), TimestampFractionDigits: FractionDigits(9)}.Marshal(tt.d)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(actual))
+	}
+
+	ref := time.Date(2023, 8, 29, 0, 0, 0, 0, time.UTC)
+	actual, err := MarshalOptions{TimestampsRelativeTo: ref, DurationFractionDigits: FractionDigits(6)}.Marshal(timestamppb.New(ref.Add(time.Second)))
+	require.NoError(t, err)
+	require.Equal(t, `"1.000000s"`, string(actual))
+
+	for _, digits := range []int{-1, 1, 2, 4, 10} {
+		_, err := NewEncoder(MarshalOptions{DurationFractionDigits: FractionDigits(digits)})
+		require.Error(t, err, digits)
+	}
+}
+
+func TestUntypedAnyKey(t *testing.T) {
+	m := &anypb.Any{Value: []byte{0x0a, 0x01, 'a'}}
+	_, err := Marshal(m)
+	require.Error(t, err)
+
+	actual, err := MarshalOptions{UntypedAnyKey: "raw"}.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, `{"raw":"CgFh"}`, string(actual))
+
+	actual, err = MarshalOptions{UntypedAnyKey: "raw"}.Marshal(&anypb.Any{})
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(actual))
+}
+
+func TestTimestampsRelativeTo(t *testing.T) {
+	ref := time.Date(2023, 8, 29, 0, 0, 10, 0, time.UTC)
+	tests := []struct {
+		ts   time.Time
+		want string
+	}{
+		{ref.Add(-5 * time.Second), `"-5s"`},
+		{ref.Add(1500 * time.Millisecond), `"1.500s"`},
+		{ref.Add(-1500 * time.Millisecond), `"-1.500s"`},
+		{ref.Add(-time.Millisecond), `"-0.001s"`},
+		{ref, `"0s"`},
+	}
+	for _, tt := range tests {
+		actual, err := MarshalOptions{TimestampsRelativeTo: ref}.Marshal(timestamppb.New(tt.ts))
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(actual), tt.ts)
+	}
+
+	actual, err := Marshal(timestamppb.New(ref))
+	require.NoError(t, err)
+	require.Equal(t, `"2023-08-29T00:00:10Z"`, string(actual))
+}